@@ -0,0 +1,147 @@
+// Command vmasm assembles VM programs.
+//
+//	vmasm [flags] prog.vm [lib.vm...]
+//
+// A single source file is assembled into a program. When more than one file
+// is given each is assembled as an object and they are linked together, with
+// the first file providing page 0. Includes are resolved relative to the
+// directory of each source file. The program is written in the format read by
+// vm.ReadProgram.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/dist-ribut-us/vm"
+	"github.com/dist-ribut-us/vm/ops"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// defines collects -D flags
+type defines map[string]vm.Qword
+
+func (d defines) String() string {
+	names := make([]string, 0, len(d))
+	for name := range d {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+func (d defines) Set(s string) error {
+	idx := strings.Index(s, "=")
+	if idx < 1 {
+		return fmt.Errorf("define must be NAME=value: %q", s)
+	}
+	q, err := vm.ParseValue(s[idx+1:])
+	if err != nil {
+		return fmt.Errorf("define %s: %s", s[:idx], err)
+	}
+	d[s[:idx]] = q
+	return nil
+}
+
+func main() {
+	defs := defines{}
+	flag.Var(defs, "D", "define `NAME=value` as if by #def, overriding any #def of NAME, can be repeated")
+	listing := flag.Bool("l", false, "print a listing instead of writing the program")
+	debug := flag.String("g", "", "write debug info as JSON to `file`, only for a single source file")
+	out := flag.String("o", "", "output `file`, defaults to the first source file with a .bin extension")
+	opSet := flag.String("ops", "default", "`name` of the op set to assemble against")
+	flag.Parse()
+	if flag.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "usage: vmasm [flags] prog.vm [lib.vm...]")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	list, ok := ops.Sets[*opSet]
+	if !ok {
+		fail(fmt.Errorf("unknown op set %q", *opSet))
+	}
+	a := list.Assembler()
+	a.Defines = defs
+
+	var pages [][]byte
+	if flag.NArg() == 1 {
+		src := flag.Arg(0)
+		name, code := read(a, src)
+		if *listing {
+			l, err := a.Listing(name, code)
+			if err != nil {
+				fail(err)
+			}
+			fmt.Print(l)
+			return
+		}
+		var d *vm.DebugInfo
+		var err error
+		pages, d, err = a.AssembleDebug(name, code)
+		if err != nil {
+			fail(err)
+		}
+		if *debug != "" {
+			b, err := json.MarshalIndent(d, "", "  ")
+			if err != nil {
+				fail(err)
+			}
+			if err := os.WriteFile(*debug, b, 0644); err != nil {
+				fail(err)
+			}
+		}
+	} else {
+		if *listing || *debug != "" {
+			fail(fmt.Errorf("-l and -g need a single source file"))
+		}
+		var objs []*vm.Object
+		for _, src := range flag.Args() {
+			name, code := read(a, src)
+			o, err := a.Object(name, code)
+			if err != nil {
+				fail(err)
+			}
+			objs = append(objs, o)
+		}
+		var err error
+		pages, err = vm.Link(objs...)
+		if err != nil {
+			fail(err)
+		}
+	}
+
+	if *out == "" {
+		src := flag.Arg(0)
+		*out = strings.TrimSuffix(src, filepath.Ext(src)) + ".bin"
+	}
+	f, err := os.Create(*out)
+	if err != nil {
+		fail(err)
+	}
+	if err := vm.WriteProgram(f, pages); err != nil {
+		fail(err)
+	}
+	if err := f.Close(); err != nil {
+		fail(err)
+	}
+}
+
+// read returns the name and code of a source file and points the assembler at
+// its directory for includes.
+func read(a *vm.Assembler, src string) (string, string) {
+	code, err := os.ReadFile(src)
+	if err != nil {
+		fail(err)
+	}
+	a.FS = os.DirFS(filepath.Dir(src))
+	return filepath.Base(src), string(code)
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,230 @@
+// Command vmdbg is an interactive debugger for VM programs.
+//
+//	vmdbg [flags] prog
+//
+// The program can be source or a program written by vmasm, labels can only be
+// used with source or with the debug info written by vmasm -g given with -g. Type h at the prompt for a list of commands. The last
+// -history steps are recorded so they can be stepped back over with bs.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/dist-ribut-us/vm"
+	"github.com/dist-ribut-us/vm/debug"
+	"github.com/dist-ribut-us/vm/ops"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const help = `commands:
+  b LOC        set a breakpoint, LOC is a label, page:pos or pos
+  d LOC        delete a breakpoint
+  bl           list breakpoints
+  wr N         watch register N
+  wm LOC N     watch N bytes of memory
+  s [N]        step N ops
+  bs [N]       step back N ops
+  c            continue to the next breakpoint
+  r            show registers
+  r N VALUE    set register N
+  x LOC [N]    show N bytes of memory
+  w LOC VALUE  write VALUE as 8 bytes
+  l            show the current op
+  bt           show the call stack
+  h            show this help
+  q            quit`
+
+func main() {
+	n := flag.Int("n", 16, "number of registers")
+	opSet := flag.String("ops", "default", "`name` of the op set to use")
+	history := flag.Int("history", 10000, "number of `steps` that can be stepped back")
+	infoFile := flag.String("g", "", "read debug info from `file` written by vmasm -g")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: vmdbg [flags] prog")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	list, ok := ops.Sets[*opSet]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown op set %q\n", *opSet)
+		os.Exit(1)
+	}
+	pages, info, err := debug.Load(list, flag.Arg(0), *infoFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	v := vm.New(make([]vm.Qword, *n), pages[0], list.Ops())
+	v.Pages = pages
+	v.Record(*history)
+	repl(debug.New(v, list, info), os.Stdin, os.Stdout)
+}
+
+func repl(d *debug.Debugger, in io.Reader, out io.Writer) {
+	fmt.Fprintln(out, d.Describe())
+	s := bufio.NewScanner(in)
+	for fmt.Fprint(out, "> "); s.Scan(); fmt.Fprint(out, "> ") {
+		args := strings.Fields(s.Text())
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "q" {
+			return
+		}
+		if err := command(d, args, out); err != nil {
+			fmt.Fprintln(out, "error:", err)
+		}
+	}
+}
+
+func command(d *debug.Debugger, args []string, out io.Writer) error {
+	switch args[0] {
+	case "b", "d":
+		if len(args) != 2 {
+			return fmt.Errorf("%s needs a location", args[0])
+		}
+		l, err := d.Resolve(args[1])
+		if err != nil {
+			return err
+		}
+		if args[0] == "b" {
+			d.Break(l)
+		} else {
+			d.Clear(l)
+		}
+	case "bl":
+		for _, l := range d.Breakpoints() {
+			fmt.Fprintln(out, l)
+		}
+	case "s":
+		n := 1
+		if len(args) > 1 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < n; i++ {
+			if err := d.Step(); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(out, d.Describe())
+	case "bs":
+		n := 1
+		if len(args) > 1 {
+			var err error
+			if n, err = strconv.Atoi(args[1]); err != nil {
+				return err
+			}
+		}
+		if err := d.Back(n); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, d.Describe())
+	case "wr":
+		if len(args) != 2 {
+			return fmt.Errorf("wr needs a register")
+		}
+		r, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		d.VM.WatchRegister(r)
+	case "wm":
+		if len(args) != 3 {
+			return fmt.Errorf("wm needs a location and a size")
+		}
+		l, err := d.Resolve(args[1])
+		if err != nil {
+			return err
+		}
+		n, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return err
+		}
+		d.VM.WatchMemory(l.Page, l.Pos, n)
+	case "c":
+		hit, err := d.Continue()
+		if err != nil {
+			return err
+		}
+		if hit != nil {
+			fmt.Fprintf(out, "%s: ", hit)
+		} else {
+			fmt.Fprint(out, "stopped: ")
+		}
+		fmt.Fprintln(out, d.Describe())
+	case "r":
+		if len(args) == 3 {
+			i, err := strconv.ParseUint(args[1], 10, 64)
+			if err != nil {
+				return err
+			}
+			q, err := vm.ParseValue(args[2])
+			if err != nil {
+				return err
+			}
+			return d.SetRegister(i, q)
+		}
+		for i, q := range d.VM.Registers {
+			fmt.Fprintf(out, "%3d: 0x%016x %s\n", i, uint64(q), vm.FormatValue(q))
+		}
+	case "x":
+		if len(args) < 2 {
+			return fmt.Errorf("x needs a location")
+		}
+		l, err := d.Resolve(args[1])
+		if err != nil {
+			return err
+		}
+		n := uint64(32)
+		if len(args) > 2 {
+			if n, err = strconv.ParseUint(args[2], 10, 64); err != nil {
+				return err
+			}
+		}
+		b, err := d.Read(l, n)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(b); i += 16 {
+			end := i + 16
+			if end > len(b) {
+				end = len(b)
+			}
+			fmt.Fprintf(out, "%d:%d  % x\n", l.Page, l.Pos+uint64(i), b[i:end])
+		}
+	case "w":
+		if len(args) != 3 {
+			return fmt.Errorf("w needs a location and a value")
+		}
+		l, err := d.Resolve(args[1])
+		if err != nil {
+			return err
+		}
+		q, err := vm.ParseValue(args[2])
+		if err != nil {
+			return err
+		}
+		b := make([]byte, 8)
+		q.Put(&b[0])
+		return d.Write(l, b)
+	case "l":
+		fmt.Fprintln(out, d.Describe())
+	case "bt":
+		for _, s := range d.Backtrace() {
+			fmt.Fprintln(out, s)
+		}
+	case "h":
+		fmt.Fprintln(out, help)
+	default:
+		return fmt.Errorf("unknown command %q, h for help", args[0])
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+// Command vmfmt formats VM assembly.
+//
+//	vmfmt [-l] [-w] [files...]
+//
+// With no files it formats stdin to stdout. With -l it lists the files that
+// are not formatted and exits with status 1 if there are any, which is useful
+// as a pre-commit check.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/dist-ribut-us/vm"
+	"io"
+	"os"
+)
+
+func main() {
+	list := flag.Bool("l", false, "list files whose formatting differs and exit 1 if there are any")
+	write := flag.Bool("w", false, "write the result to the source file instead of stdout")
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		src, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			fail(err)
+		}
+		fmt.Print(vm.Format(string(src)))
+		return
+	}
+
+	unformatted := false
+	for _, name := range flag.Args() {
+		src, err := os.ReadFile(name)
+		if err != nil {
+			fail(err)
+		}
+		out := vm.Format(string(src))
+		if out == string(src) {
+			if !*list && !*write {
+				fmt.Print(out)
+			}
+			continue
+		}
+		unformatted = true
+		if *list {
+			fmt.Println(name)
+		}
+		if *write {
+			if err := os.WriteFile(name, []byte(out), 0644); err != nil {
+				fail(err)
+			}
+		}
+		if !*list && !*write {
+			fmt.Print(out)
+		}
+	}
+	if *list && unformatted {
+		os.Exit(1)
+	}
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
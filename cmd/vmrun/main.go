@@ -0,0 +1,300 @@
+// Command vmrun runs a VM program locally.
+//
+//	vmrun [flags] prog
+//
+// The program can be source or a program written by vmasm. Registers can be
+// set with -r, for instance -r 0=5,1=2.5, or from a JSON file holding an array
+// of numbers with -regs. After running, the registers, the size of each page,
+// the number of ops run and any fault are printed as text or with -json as
+// JSON. The exit status is 1 if the program faulted.
+//
+// With -trace every op is written to a file as a line of JSON, or in the
+// binary trace format with -tracefmt bin. With -profile a profile is written
+// in the pprof format for go tool pprof. With -cover a coverage report is
+// written as text, or as annotated HTML if the file name ends in .html, this
+// needs the program to be source or the debug info from vmasm -g given with
+// -g. If the coverage is below -covermin percent
+// vmrun exits with status 1. With -hash the SHA-256 digest of a transcript of
+// every op and the changes it made is printed, so runs can be compared. Use
+// -strict for floating point results that are bit-identical on every host.
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/dist-ribut-us/vm"
+	"github.com/dist-ribut-us/vm/cover"
+	"github.com/dist-ribut-us/vm/debug"
+	"github.com/dist-ribut-us/vm/ops"
+	"github.com/dist-ribut-us/vm/profile"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type result struct {
+	Registers []uint64 `json:"registers"`
+	Pages     []int    `json:"pages"`
+	Count     uint64   `json:"count"`
+	Page      uint64   `json:"page"`
+	Pos       uint64   `json:"pos"`
+	Fault     string   `json:"fault,omitempty"`
+	Location  string   `json:"location,omitempty"`
+	Hash      string   `json:"hash,omitempty"`
+}
+
+func main() {
+	regFlag := flag.String("r", "", "initial registers as `idx=value,...`")
+	regFile := flag.String("regs", "", "JSON `file` holding an array of initial register values")
+	n := flag.Int("n", 16, "minimum number of registers")
+	gas := flag.Uint64("gas", 0, "maximum number of ops to run, 0 for no limit")
+	mem := flag.Uint64("mem", 0, "maximum total bytes of memory, 0 for no limit")
+	timeout := flag.Duration("timeout", 0, "maximum time to run, 0 for no limit")
+	asJSON := flag.Bool("json", false, "print the result as JSON")
+	opSet := flag.String("ops", "default", "`name` of the op set to use")
+	strict := flag.Bool("strict", false, "make every NaN the canonical NaN")
+	traceFile := flag.String("trace", "", "write a trace of every op to `file`")
+	traceFmt := flag.String("tracefmt", "json", "trace `format`, json or bin")
+	profFile := flag.String("profile", "", "write a pprof profile to `file`")
+	coverFile := flag.String("cover", "", "write a coverage report to `file`")
+	coverMin := flag.Float64("covermin", 0, "minimum coverage `percent` needed with -cover")
+	hashRun := flag.Bool("hash", false, "print a digest of the transcript of the run")
+	infoFile := flag.String("g", "", "read debug info from `file` written by vmasm -g")
+	flag.Parse()
+	if flag.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: vmrun [flags] prog")
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+
+	list, ok := ops.Sets[*opSet]
+	if !ok {
+		fail(fmt.Errorf("unknown op set %q", *opSet))
+	}
+	pages, info, err := debug.Load(list, flag.Arg(0), *infoFile)
+	if err != nil {
+		fail(err)
+	}
+	regs, err := registers(*regFlag, *regFile, *n)
+	if err != nil {
+		fail(err)
+	}
+
+	v := vm.New(regs, pages[0], list.Ops())
+	v.Pages = pages
+	v.GasLimit = *gas
+	v.MaxMemory = *mem
+	v.StrictFloat = *strict
+	if *timeout > 0 {
+		v.Deadline = time.Now().Add(*timeout)
+	}
+	var tracers []vm.Tracer
+	var tw *vm.TraceWriter
+	var traceOut *os.File
+	var w *bufio.Writer
+	if *traceFile != "" {
+		traceOut, err = os.Create(*traceFile)
+		if err != nil {
+			fail(err)
+		}
+		w = bufio.NewWriter(traceOut)
+		switch *traceFmt {
+		case "json":
+			tw = vm.JSONTracer(w)
+		case "bin":
+			tw = vm.BinaryTracer(w)
+		default:
+			fail(fmt.Errorf("unknown trace format %q", *traceFmt))
+		}
+		tracers = append(tracers, tw)
+	}
+	var prof *profile.Profiler
+	if *profFile != "" {
+		prof = profile.New()
+		tracers = append(tracers, prof)
+	}
+	var cov *cover.Coverage
+	if *coverFile != "" {
+		if info == nil {
+			fail(fmt.Errorf("coverage needs the program source or -g"))
+		}
+		cov = cover.New()
+		tracers = append(tracers, cov)
+	}
+	var ts *vm.Transcript
+	if *hashRun {
+		ts = vm.NewTranscript()
+		tracers = append(tracers, ts)
+	}
+	v.Trace(list, tracers...)
+	runErr := v.Run()
+	if tw != nil {
+		err = tw.Err()
+		if err == nil {
+			err = w.Flush()
+		}
+		if cerr := traceOut.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			fail(err)
+		}
+	}
+	if prof != nil {
+		if err := writeProfile(*profFile, prof, info); err != nil {
+			fail(err)
+		}
+	}
+	if cov != nil {
+		if err := writeCover(*coverFile, cov, info, flag.Arg(0)); err != nil {
+			fail(err)
+		}
+		if pct := cov.Percent(info); pct < *coverMin {
+			fail(fmt.Errorf("coverage %.1f%% is below %.1f%%", pct, *coverMin))
+		}
+	}
+
+	r := result{
+		Registers: make([]uint64, len(v.Registers)),
+		Pages:     make([]int, len(v.Pages)),
+		Count:     v.Count,
+		Page:      v.Page,
+		Pos:       v.Pos,
+	}
+	for i, q := range v.Registers {
+		r.Registers[i] = q.GetU()
+	}
+	if ts != nil {
+		sum := ts.Sum()
+		r.Hash = hex.EncodeToString(sum[:])
+	}
+	for i, p := range v.Pages {
+		r.Pages[i] = len(p)
+	}
+	if runErr != nil {
+		r.Fault = runErr.Error()
+		if info != nil {
+			r.Location = info.Describe(v.Page, v.Pos)
+		} else {
+			r.Location = fmt.Sprintf("%d:%d", v.Page, v.Pos)
+		}
+	}
+
+	if *asJSON {
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			fail(err)
+		}
+		fmt.Println(string(b))
+	} else {
+		printText(r)
+	}
+	if runErr != nil {
+		os.Exit(1)
+	}
+}
+
+// registers builds the initial registers from the JSON file, then the flag.
+func registers(regFlag, regFile string, n int) ([]vm.Qword, error) {
+	regs := make([]vm.Qword, n)
+	set := func(idx int, s string) error {
+		q, err := vm.ParseValue(s)
+		if err != nil {
+			return fmt.Errorf("register %d: %s", idx, err)
+		}
+		for len(regs) <= idx {
+			regs = append(regs, 0)
+		}
+		regs[idx] = q
+		return nil
+	}
+
+	if regFile != "" {
+		data, err := os.ReadFile(regFile)
+		if err != nil {
+			return nil, err
+		}
+		var vals []json.Number
+		if err := json.Unmarshal(data, &vals); err != nil {
+			return nil, err
+		}
+		for i, val := range vals {
+			if err := set(i, val.String()); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if regFlag != "" {
+		for _, kv := range strings.Split(regFlag, ",") {
+			idx := strings.Index(kv, "=")
+			if idx < 1 {
+				return nil, fmt.Errorf("register must be idx=value: %q", kv)
+			}
+			i, err := strconv.Atoi(kv[:idx])
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("bad register index: %q", kv)
+			}
+			if err := set(i, kv[idx+1:]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return regs, nil
+}
+
+func printText(r result) {
+	fmt.Println("registers:")
+	for i, q := range r.Registers {
+		fmt.Printf("  %3d: 0x%016x %s\n", i, q, vm.FormatValue(vm.Qword(q)))
+	}
+	fmt.Println("pages:")
+	for i, size := range r.Pages {
+		fmt.Printf("  %3d: %d bytes\n", i, size)
+	}
+	fmt.Println("count:", r.Count)
+	if r.Hash != "" {
+		fmt.Println("hash:", r.Hash)
+	}
+	if r.Fault != "" {
+		fmt.Printf("fault: %s at %s\n", r.Fault, r.Location)
+	}
+}
+
+func writeProfile(name string, prof *profile.Profiler, info *vm.DebugInfo) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	err = prof.WritePprof(f, info)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func writeCover(name string, cov *cover.Coverage, info *vm.DebugInfo, prog string) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	if strings.HasSuffix(name, ".html") {
+		err = cov.WriteHTML(f, info, os.DirFS(filepath.Dir(prog)))
+	} else {
+		err = cov.WriteText(f, info)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
@@ -0,0 +1,167 @@
+// Package cover records which instructions of a VM program have run and
+// reports the coverage of the source lines as text or as annotated HTML.
+package cover
+
+import (
+	"fmt"
+	"github.com/dist-ribut-us/vm"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// Coverage is a vm.Tracer that counts how many times each location runs. The
+// same Coverage can be used for several runs to combine their coverage.
+type Coverage struct {
+	Counts map[vm.Location]uint64
+}
+
+// New creates a Coverage, it is started by passing it to VM.Trace.
+func New() *Coverage {
+	return &Coverage{
+		Counts: make(map[vm.Location]uint64),
+	}
+}
+
+// Before fulfils vm.Tracer
+func (c *Coverage) Before(_ *vm.VM, _ *vm.TraceEvent) {}
+
+// After fulfils vm.Tracer
+func (c *Coverage) After(_ *vm.VM, e *vm.TraceEvent) {
+	c.Counts[e.At]++
+}
+
+// Merge adds the counts from another Coverage.
+func (c *Coverage) Merge(other *Coverage) {
+	for l, n := range other.Counts {
+		c.Counts[l] += n
+	}
+}
+
+// Line is the coverage of a source line. Ops is the number of ops that came
+// from the line, a line in a macro can produce an op every time the macro is
+// used, and Covered is how many of them ran. Count is the number of times the
+// ops from the line ran.
+type Line struct {
+	File    string
+	Line    int
+	Ops     int
+	Covered int
+	Count   uint64
+}
+
+// Lines returns the coverage of every line that produced an op, sorted by file
+// and line.
+func (c *Coverage) Lines(info *vm.DebugInfo) []Line {
+	type key struct {
+		file string
+		line int
+	}
+	byLine := make(map[key]*Line)
+	var ls []*Line
+	for _, li := range info.Lines {
+		if !li.Op {
+			continue
+		}
+		k := key{li.File, li.Line}
+		l, ok := byLine[k]
+		if !ok {
+			l = &Line{File: li.File, Line: li.Line}
+			byLine[k] = l
+			ls = append(ls, l)
+		}
+		l.Ops++
+		if n := c.Counts[vm.Location{Page: li.Page, Pos: li.Pos}]; n > 0 {
+			l.Covered++
+			l.Count += n
+		}
+	}
+	sort.Slice(ls, func(i, j int) bool {
+		if ls[i].File != ls[j].File {
+			return ls[i].File < ls[j].File
+		}
+		return ls[i].Line < ls[j].Line
+	})
+	out := make([]Line, len(ls))
+	for i, l := range ls {
+		out[i] = *l
+	}
+	return out
+}
+
+// File is the coverage of a source file.
+type File struct {
+	Name         string
+	Ops, Covered int
+}
+
+// Percent returns the percentage of ops that ran, a file with no ops is fully
+// covered.
+func (f File) Percent() float64 {
+	if f.Ops == 0 {
+		return 100
+	}
+	return 100 * float64(f.Covered) / float64(f.Ops)
+}
+
+// Files returns the coverage of each file, sorted by name.
+func Files(lines []Line) []File {
+	var fs []File
+	for _, l := range lines {
+		if len(fs) == 0 || fs[len(fs)-1].Name != l.File {
+			fs = append(fs, File{Name: l.File})
+		}
+		f := &fs[len(fs)-1]
+		f.Ops += l.Ops
+		f.Covered += l.Covered
+	}
+	return fs
+}
+
+// Total returns the coverage of all of the lines, the Name is "total".
+func Total(lines []Line) File {
+	t := File{Name: "total"}
+	for _, l := range lines {
+		t.Ops += l.Ops
+		t.Covered += l.Covered
+	}
+	return t
+}
+
+// Percent returns the percentage of the ops in the program that ran.
+func (c *Coverage) Percent(info *vm.DebugInfo) float64 {
+	return Total(c.Lines(info)).Percent()
+}
+
+// WriteText writes the coverage of each file and the total followed by every
+// line with an op that did not run.
+func (c *Coverage) WriteText(w io.Writer, info *vm.DebugInfo) error {
+	lines := c.Lines(info)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, f := range append(Files(lines), Total(lines)) {
+		name := f.Name
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%.1f%%\t(%d/%d ops)\n", name, f.Percent(), f.Covered, f.Ops)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, l := range lines {
+		if l.Covered == l.Ops {
+			continue
+		}
+		li := vm.LineInfo{File: l.File, Line: l.Line}
+		var err error
+		if l.Covered == 0 {
+			_, err = fmt.Fprintf(w, "%s: not run\n", li.Position())
+		} else {
+			_, err = fmt.Fprintf(w, "%s: %d of %d ops run\n", li.Position(), l.Covered, l.Ops)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
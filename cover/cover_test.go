@@ -0,0 +1,62 @@
+package cover
+
+import (
+	"bytes"
+	"github.com/dist-ribut-us/vm"
+	"github.com/dist-ribut-us/vm/ops"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCoverage(t *testing.T) {
+	src := `set   0 1
+jumpv 0 0 done
+set   1 5
+done:
+stop
+`
+	a := ops.List.Assembler()
+	pages, info, err := a.AssembleDebug("branch.vm", src)
+	assert.NoError(t, err)
+
+	c := New()
+	v := vm.New(make([]vm.Qword, 2), pages[0], ops.List.Ops())
+	v.Trace(ops.List, c)
+	assert.NoError(t, v.Run())
+
+	lines := c.Lines(info)
+	assert.Equal(t, []Line{
+		{File: "branch.vm", Line: 1, Ops: 1, Covered: 1, Count: 1},
+		{File: "branch.vm", Line: 2, Ops: 1, Covered: 1, Count: 1},
+		{File: "branch.vm", Line: 3, Ops: 1},
+		{File: "branch.vm", Line: 5, Ops: 1, Covered: 1, Count: 1},
+	}, lines)
+	assert.Equal(t, 75.0, c.Percent(info))
+
+	var text bytes.Buffer
+	assert.NoError(t, c.WriteText(&text, info))
+	assert.Equal(t, "branch.vm  75.0%  (3/4 ops)\n"+
+		"total      75.0%  (3/4 ops)\n"+
+		"branch.vm:3: not run\n", text.String())
+
+	var html bytes.Buffer
+	assert.NoError(t, c.WriteHTML(&html, info, fstest.MapFS{
+		"branch.vm": &fstest.MapFile{Data: []byte(src)},
+	}))
+	out := html.String()
+	assert.Contains(t, out, `<span class="missed" title="0/1 ops run, 0 times">set   1 5</span>`)
+	assert.Contains(t, out, `<span class="run" title="1/1 ops run, 1 times">stop</span>`)
+	assert.Contains(t, out, "done:\n")
+
+	// a second run that does not jump combines the coverage
+	pages[0][10] = 0 // set 0 0
+	v = vm.New(make([]vm.Qword, 2), pages[0], ops.List.Ops())
+	v.Trace(ops.List, c)
+	assert.NoError(t, v.Run())
+	assert.Equal(t, 100.0, c.Percent(info))
+
+	html.Reset()
+	assert.NoError(t, c.WriteHTML(&html, info, fstest.MapFS{}))
+	assert.Contains(t, html.String(), "source not available")
+}
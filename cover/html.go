@@ -0,0 +1,99 @@
+package cover
+
+import (
+	"fmt"
+	"github.com/dist-ribut-us/vm"
+	"html/template"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+var htmlTemplate = template.Must(template.New("cover").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>VM coverage</title>
+<style>
+body { font-family: sans-serif; }
+pre { background: #f8f8f8; padding: 8px; }
+.run { background: #c8f0c8; }
+.partial { background: #f0f0a0; }
+.missed { background: #f0c0c0; }
+.num { color: #888; }
+</style>
+</head>
+<body>
+<h1>Coverage {{printf "%.1f" .Total.Percent}}%</h1>
+{{range .Files}}<h2>{{.Name}} {{printf "%.1f" .Percent}}% ({{.Covered}}/{{.Ops}} ops)</h2>
+{{if .Missing}}<p>source not available</p>
+{{else}}<pre>{{range .Lines}}<span class="num">{{printf "%4d" .Number}}</span> {{if .Class}}<span class="{{.Class}}" title="{{.Title}}">{{.Text}}</span>{{else}}{{.Text}}{{end}}
+{{end}}</pre>
+{{end}}{{end}}</body>
+</html>
+`))
+
+type htmlFile struct {
+	File
+	Missing bool
+	Lines   []htmlLine
+}
+
+type htmlLine struct {
+	Number       int
+	Text         string
+	Class, Title string
+}
+
+// WriteHTML writes the source of each file with the lines that ran, partly ran
+// and did not run highlighted. The source is read from src using the file
+// names in info.
+func (c *Coverage) WriteHTML(w io.Writer, info *vm.DebugInfo, src fs.FS) error {
+	lines := c.Lines(info)
+	byFile := make(map[string]map[int]Line)
+	for _, l := range lines {
+		if byFile[l.File] == nil {
+			byFile[l.File] = make(map[int]Line)
+		}
+		byFile[l.File][l.Line] = l
+	}
+
+	var files []htmlFile
+	for _, f := range Files(lines) {
+		hf := htmlFile{File: f}
+		data, err := fs.ReadFile(src, f.Name)
+		if err != nil {
+			hf.Missing = true
+			files = append(files, hf)
+			continue
+		}
+		text := strings.TrimSuffix(string(data), "\n")
+		for i, s := range strings.Split(text, "\n") {
+			hl := htmlLine{
+				Number: i + 1,
+				Text:   s,
+			}
+			if l, ok := byFile[f.Name][i+1]; ok {
+				switch {
+				case l.Covered == l.Ops:
+					hl.Class = "run"
+				case l.Covered == 0:
+					hl.Class = "missed"
+				default:
+					hl.Class = "partial"
+				}
+				hl.Title = fmt.Sprintf("%d/%d ops run, %d times", l.Covered, l.Ops, l.Count)
+			}
+			hf.Lines = append(hf.Lines, hl)
+		}
+		files = append(files, hf)
+	}
+
+	return htmlTemplate.Execute(w, struct {
+		Total File
+		Files []htmlFile
+	}{
+		Total: Total(lines),
+		Files: files,
+	})
+}
@@ -0,0 +1,124 @@
+package vm
+
+import (
+	"strconv"
+	"strings"
+)
+
+// qword handles "#qword V..." which places each value in the program as 8
+// bytes. Values can be numbers, definitions or labels.
+func (p *programmer) qword(line lexedLine) error {
+	for _, arg := range line.word[1:] {
+		pos := len(p.program)
+		p.program = append(p.program, make([]byte, 8)...)
+		if err := p.setArg(arg, false, pos, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// float handles "#float F..." which places each value in the program as an 8
+// byte float, numbers without a decimal point are also treated as floats.
+func (p *programmer) float(line lexedLine) error {
+	for _, arg := range line.word[1:] {
+		f, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return line.Error("Bad number")
+		}
+		pos := len(p.program)
+		p.program = append(p.program, make([]byte, 8)...)
+		QwordF(f).Put(&p.program[pos])
+	}
+	return nil
+}
+
+// bytes handles "#bytes B..." which places each value in the program as a
+// single byte.
+func (p *programmer) bytes(line lexedLine) error {
+	for _, arg := range line.word[1:] {
+		b, err := strconv.ParseUint(arg, 10, 8)
+		if err != nil {
+			return line.Error("Bad byte")
+		}
+		p.program = append(p.program, byte(b))
+	}
+	return nil
+}
+
+// string handles `#string "S"...` which places the bytes of each string in the
+// program. No length or terminator is added.
+func (p *programmer) string(line lexedLine) error {
+	for _, arg := range line.word[1:] {
+		s, err := strconv.Unquote(arg)
+		if err != nil || !strings.HasPrefix(arg, `"`) {
+			return line.Error("Bad string")
+		}
+		p.program = append(p.program, s...)
+	}
+	return nil
+}
+
+// align handles "#align N" which pads the program with zeros until its length
+// is a multiple of N.
+func (p *programmer) align(line lexedLine) error {
+	n, err := p.size(line)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return line.Error("Alignment must be greater than 0")
+	}
+	p.aligns[p.page] = lcm(p.aligns[p.page], n)
+	if r := len(p.program) % n; r != 0 {
+		p.program = append(p.program, make([]byte, n-r)...)
+	}
+	return nil
+}
+
+// lcm returns the least common multiple of a and n, a is 0 if there is no
+// alignment yet.
+func lcm(a, n int) int {
+	if a == 0 {
+		return n
+	}
+	x, y := a, n
+	for y != 0 {
+		x, y = y, x%y
+	}
+	return a / x * n
+}
+
+// zero handles "#zero N" which places N zero bytes in the program.
+func (p *programmer) zero(line lexedLine) error {
+	n, err := p.size(line)
+	if err != nil {
+		return err
+	}
+	p.program = append(p.program, make([]byte, n)...)
+	return nil
+}
+
+// size reads the single size argument of #align and #zero. It can be a number
+// or a definition.
+func (p *programmer) size(line lexedLine) (int, error) {
+	if len(line.word) != 2 {
+		return 0, line.Error("Wrong number of arguments")
+	}
+	arg := line.word[1]
+	if isName(arg) {
+		v := p.vars[p.scoped(arg)]
+		if !v.defined {
+			return 0, line.Error("Not defined")
+		}
+		if v.value > 1<<32 {
+			return 0, line.Error("Bad size")
+		}
+		return int(v.value), nil
+	}
+	n, err := strconv.ParseUint(arg, 10, 32)
+	if err != nil {
+		return 0, line.Error("Bad size")
+	}
+	return int(n), nil
+}
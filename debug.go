@@ -0,0 +1,133 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// DebugInfo maps a program back to its source. Lines are sorted by page and
+// position and Symbols holds every label, section and definition sorted by
+// name.
+type DebugInfo struct {
+	Lines   []LineInfo
+	Symbols []Symbol
+}
+
+// LineInfo records the source line that produced the bytes starting at Pos in
+// Page. If the line came from a macro, it is the line in the macro body. Op is
+// true if the line is an op rather than data.
+type LineInfo struct {
+	Page, Pos uint64
+	File      string
+	Line      int
+	Op        bool
+}
+
+// Position returns the line number, prefixed by the file name if there is one.
+func (li LineInfo) Position() string {
+	return position(li.File, li.Line)
+}
+
+// AssembleDebug works like AssemblePages and also returns the DebugInfo for
+// the program.
+func (a *Assembler) AssembleDebug(name, code string) ([][]byte, *DebugInfo, error) {
+	p := a.programmer()
+	if err := p.lex(name, code, nil); err != nil {
+		return nil, nil, err
+	}
+	if err := p.parse(); err != nil {
+		return nil, nil, err
+	}
+	if err := p.resolve(); err != nil {
+		return nil, nil, err
+	}
+	return p.pages, p.debugInfo(), nil
+}
+
+func (p *programmer) debugInfo() *DebugInfo {
+	d := &DebugInfo{
+		Lines: p.lines,
+	}
+	for name, v := range p.vars {
+		s := Symbol{
+			Name:  name,
+			Value: v.value,
+		}
+		switch {
+		case v.label:
+			s.Kind = SymbolLabel
+			s.Section = int(v.page)
+		case v.section:
+			s.Kind = SymbolSection
+			s.Section = int(v.value)
+		}
+		d.Symbols = append(d.Symbols, s)
+	}
+	sort.Slice(d.Symbols, func(i, j int) bool {
+		return d.Symbols[i].Name < d.Symbols[j].Name
+	})
+	sort.SliceStable(d.Lines, func(i, j int) bool {
+		li, lj := d.Lines[i], d.Lines[j]
+		if li.Page != lj.Page {
+			return li.Page < lj.Page
+		}
+		return li.Pos < lj.Pos
+	})
+	return d
+}
+
+// Line returns the source line for the instruction or data at pos in page.
+func (d *DebugInfo) Line(page, pos uint64) (LineInfo, bool) {
+	i := sort.Search(len(d.Lines), func(i int) bool {
+		l := d.Lines[i]
+		return l.Page > page || (l.Page == page && l.Pos > pos)
+	}) - 1
+	if i < 0 || d.Lines[i].Page != page {
+		return LineInfo{}, false
+	}
+	return d.Lines[i], true
+}
+
+// Lookup returns the symbol with the given name.
+func (d *DebugInfo) Lookup(name string) (Symbol, bool) {
+	i := sort.Search(len(d.Symbols), func(i int) bool {
+		return d.Symbols[i].Name >= name
+	})
+	if i == len(d.Symbols) || d.Symbols[i].Name != name {
+		return Symbol{}, false
+	}
+	return d.Symbols[i], true
+}
+
+// Label returns the closest label at or before pos in page.
+func (d *DebugInfo) Label(page, pos uint64) (Symbol, bool) {
+	var best Symbol
+	var found bool
+	for _, s := range d.Symbols {
+		if s.Kind != SymbolLabel || uint64(s.Section) != page || uint64(s.Value) > pos {
+			continue
+		}
+		if !found || s.Value > best.Value {
+			best, found = s, true
+		}
+	}
+	return best, found
+}
+
+// Describe a position as label+offset followed by the source line, for
+// instance "loop+12 (script.vm:14)". Parts that are not known are left out.
+func (d *DebugInfo) Describe(page, pos uint64) string {
+	var s string
+	if l, ok := d.Label(page, pos); ok {
+		s = l.Name
+		if off := pos - uint64(l.Value); off > 0 {
+			s += fmt.Sprintf("+%d", off)
+		}
+	} else {
+		s = fmt.Sprintf("%d:%d", page, pos)
+	}
+	if li, ok := d.Line(page, pos); ok {
+		s += " (" + li.Position() + ")"
+	}
+	return s
+}
@@ -0,0 +1,248 @@
+// Package debug provides a step debugger for VM programs.
+package debug
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/dist-ribut-us/vm"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Errors returned by the Debugger
+var (
+	ErrStopped     = errors.New("program has stopped")
+	ErrNoSymbol    = errors.New("no label with that name")
+	ErrOutOfRange  = errors.New("out of range")
+	ErrBadLocation = errors.New("location must be a label, page:pos or pos")
+)
+
+// Location is a position in a page.
+type Location = vm.Location
+
+// Debugger controls a VM for debugging. Debug is optional, if it is set labels
+// can be used for breakpoints and locations are shown with the source line.
+type Debugger struct {
+	VM     *vm.VM
+	Debug  *vm.DebugInfo
+	decode func([]byte, uint64) (vm.Instruction, bool)
+}
+
+// New creates a Debugger for a VM using the ops in list to decode the program.
+func New(v *vm.VM, list vm.OpList, d *vm.DebugInfo) *Debugger {
+	return &Debugger{
+		VM:     v,
+		Debug:  d,
+		decode: list.Decoder(),
+	}
+}
+
+// Load reads a program written by vmasm or assembles source. If info is not
+// empty it names a debug info file written by vmasm -g which is returned with
+// the program, otherwise debug info is only returned for source.
+func Load(list vm.OpList, name, info string) ([][]byte, *vm.DebugInfo, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	var d *vm.DebugInfo
+	if info != "" {
+		if d, err = LoadInfo(info); err != nil {
+			return nil, nil, err
+		}
+	}
+	pages, err := vm.ReadProgram(bytes.NewReader(data))
+	if err == nil {
+		if len(pages) == 0 {
+			return nil, nil, errors.New("program has no pages")
+		}
+		return pages, d, nil
+	}
+	if err != vm.ErrNotProgram {
+		return nil, nil, err
+	}
+	a := list.Assembler()
+	a.FS = os.DirFS(filepath.Dir(name))
+	pages, src, err := a.AssembleDebug(filepath.Base(name), string(data))
+	if d == nil {
+		d = src
+	}
+	return pages, d, err
+}
+
+// LoadInfo reads a debug info file written by vmasm -g.
+func LoadInfo(name string) (*vm.DebugInfo, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	d := &vm.DebugInfo{}
+	if err := json.Unmarshal(data, d); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Resolve turns a label, "page:pos" or "pos" into a Location. A pos on its own
+// is in the current page.
+func (d *Debugger) Resolve(s string) (Location, error) {
+	if idx := strings.Index(s, ":"); idx >= 0 {
+		page, err1 := strconv.ParseUint(s[:idx], 10, 64)
+		pos, err2 := strconv.ParseUint(s[idx+1:], 10, 64)
+		if err1 != nil || err2 != nil {
+			return Location{}, ErrBadLocation
+		}
+		return Location{Page: page, Pos: pos}, nil
+	}
+	if pos, err := strconv.ParseUint(s, 10, 64); err == nil {
+		return Location{Page: d.VM.Page, Pos: pos}, nil
+	}
+	if d.Debug == nil {
+		return Location{}, ErrNoSymbol
+	}
+	sym, ok := d.Debug.Lookup(s)
+	if !ok || sym.Kind != vm.SymbolLabel {
+		return Location{}, ErrNoSymbol
+	}
+	return Location{Page: uint64(sym.Section), Pos: uint64(sym.Value)}, nil
+}
+
+// Break sets a breakpoint.
+func (d *Debugger) Break(l Location) {
+	d.VM.SetBreakpoint(l.Page, l.Pos)
+}
+
+// Clear removes a breakpoint.
+func (d *Debugger) Clear(l Location) {
+	d.VM.ClearBreakpoint(l.Page, l.Pos)
+}
+
+// Breakpoints returns all the breakpoints in order.
+func (d *Debugger) Breakpoints() []Location {
+	ls := d.VM.Breakpoints()
+	sort.Slice(ls, func(i, j int) bool {
+		if ls[i].Page != ls[j].Page {
+			return ls[i].Page < ls[j].Page
+		}
+		return ls[i].Pos < ls[j].Pos
+	})
+	return ls
+}
+
+// Location returns the current location of the VM.
+func (d *Debugger) Location() Location {
+	return Location{Page: d.VM.Page, Pos: d.VM.Pos}
+}
+
+// Step runs a single op.
+func (d *Debugger) Step() error {
+	if d.VM.Stop {
+		return ErrStopped
+	}
+	return d.VM.Step()
+}
+
+// Back undoes the last n ops, the VM must be recording with VM.Record.
+func (d *Debugger) Back(n int) error {
+	return d.VM.Back(n)
+}
+
+// Continue runs until a breakpoint or watchpoint fires, the program stops or
+// there is an error. If a breakpoint or watchpoint fired it is returned. A
+// breakpoint at the current location is ignored so Continue can be called
+// again after hitting one.
+func (d *Debugger) Continue() (*vm.Hit, error) {
+	err := d.Step()
+	if err == nil && !d.VM.Stop {
+		err = d.VM.Run()
+	}
+	if h, ok := err.(*vm.Hit); ok {
+		return h, nil
+	}
+	return nil, err
+}
+
+// Backtrace describes the current location followed by each location on the
+// call stack that will be returned to, innermost first.
+func (d *Debugger) Backtrace() []string {
+	ls := []Location{d.Location()}
+	for i := len(d.VM.Stack) - 1; i >= 0; i-- {
+		ls = append(ls, d.VM.Stack[i])
+	}
+	bt := make([]string, len(ls))
+	for i, l := range ls {
+		if d.Debug != nil {
+			bt[i] = d.Debug.Describe(l.Page, l.Pos)
+		} else {
+			bt[i] = l.String()
+		}
+	}
+	return bt
+}
+
+// Instruction decodes the op at the current location.
+func (d *Debugger) Instruction() (vm.Instruction, bool) {
+	if d.VM.Page >= uint64(len(d.VM.Pages)) {
+		return vm.Instruction{}, false
+	}
+	return d.decode(d.VM.Pages[d.VM.Page], d.VM.Pos)
+}
+
+// Describe returns the current location and the op there, for instance
+// "loop+12 (script.vm:14): iadd 2 0".
+func (d *Debugger) Describe() string {
+	var where string
+	if d.Debug != nil {
+		where = d.Debug.Describe(d.VM.Page, d.VM.Pos)
+	} else {
+		where = d.Location().String()
+	}
+	in, ok := d.Instruction()
+	if !ok {
+		return where + ": ?"
+	}
+	return where + ": " + in.String()
+}
+
+// SetRegister sets the value of register i.
+func (d *Debugger) SetRegister(i uint64, q vm.Qword) error {
+	if i >= uint64(len(d.VM.Registers)) {
+		return ErrOutOfRange
+	}
+	d.VM.Registers[i] = q
+	return nil
+}
+
+// Read returns n bytes of memory starting at l.
+func (d *Debugger) Read(l Location, n uint64) ([]byte, error) {
+	page, err := d.page(l, n)
+	if err != nil {
+		return nil, err
+	}
+	return page[l.Pos : l.Pos+n], nil
+}
+
+// Write copies data into memory starting at l.
+func (d *Debugger) Write(l Location, data []byte) error {
+	page, err := d.page(l, uint64(len(data)))
+	if err != nil {
+		return err
+	}
+	copy(page[l.Pos:], data)
+	return nil
+}
+
+func (d *Debugger) page(l Location, n uint64) ([]byte, error) {
+	if l.Page >= uint64(len(d.VM.Pages)) {
+		return nil, ErrOutOfRange
+	}
+	page := d.VM.Pages[l.Page]
+	if l.Pos > uint64(len(page)) || n > uint64(len(page))-l.Pos {
+		return nil, ErrOutOfRange
+	}
+	return page, nil
+}
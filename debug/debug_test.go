@@ -0,0 +1,133 @@
+package debug
+
+import (
+	"encoding/json"
+	"github.com/dist-ribut-us/vm"
+	"github.com/dist-ribut-us/vm/ops"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDebugger(t *testing.T) {
+	a := ops.List.Assembler()
+	pages, info, err := a.AssembleDebug("mult.vm", `
+		set   0 7
+		set   1 4
+		loop:
+		iadd  2 0
+		isubv 1 1
+		jumpv 1 0 loop
+		stop
+	`)
+	assert.NoError(t, err)
+	v := vm.New(make([]vm.Qword, 3), pages[0], ops.List.Ops())
+	d := New(v, ops.List, info)
+
+	assert.Equal(t, "0:0 (mult.vm:2): set 0 7", d.Describe())
+	assert.NoError(t, d.Step())
+	assert.Equal(t, "0:18 (mult.vm:3): set 1 4", d.Describe())
+
+	l, err := d.Resolve("loop")
+	assert.NoError(t, err)
+	assert.Equal(t, Location{Page: 0, Pos: 36}, l)
+	d.Break(l)
+	assert.Equal(t, []Location{l}, d.Breakpoints())
+
+	hit, err := d.Continue()
+	assert.NoError(t, err)
+	if assert.NotNil(t, hit) {
+		assert.Equal(t, vm.BreakpointHit, hit.Kind)
+	}
+	assert.Equal(t, "loop (mult.vm:5): iadd 2 0", d.Describe())
+
+	hit, err = d.Continue()
+	assert.NoError(t, err)
+	assert.NotNil(t, hit)
+	assert.Equal(t, vm.Qword(7), v.Registers[2])
+
+	assert.NoError(t, d.SetRegister(1, 1))
+	assert.Error(t, d.SetRegister(3, 1))
+	d.Clear(l)
+	hit, err = d.Continue()
+	assert.NoError(t, err)
+	assert.Nil(t, hit)
+	assert.Equal(t, vm.Qword(14), v.Registers[2])
+	assert.Equal(t, ErrStopped, d.Step())
+
+	assert.NoError(t, d.Write(Location{Page: 0, Pos: 10}, []byte{9}))
+	b, err := d.Read(Location{Page: 0, Pos: 10}, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{9}, b)
+	_, err = d.Read(Location{Page: 0, Pos: 1000}, 1)
+	assert.Error(t, err)
+
+	_, err = d.Resolve("missing")
+	assert.Equal(t, ErrNoSymbol, err)
+	l, err = d.Resolve("0:18")
+	assert.NoError(t, err)
+	assert.Equal(t, Location{Page: 0, Pos: 18}, l)
+}
+
+func TestBacktrace(t *testing.T) {
+	a := ops.List.Assembler()
+	pages, info, err := a.AssembleDebug("calls.vm", `
+		callv 0 outer
+		stop
+		outer:
+		callv 0 inner
+		ret
+		inner:
+		ret
+	`)
+	assert.NoError(t, err)
+	v := vm.New(nil, pages[0], ops.List.Ops())
+	d := New(v, ops.List, info)
+	assert.NoError(t, d.Step())
+	assert.NoError(t, d.Step())
+	assert.Equal(t, []string{
+		"inner (calls.vm:8)",
+		"outer+18 (calls.vm:6)",
+		"0:18 (calls.vm:3)",
+	}, d.Backtrace())
+}
+
+func TestLoad(t *testing.T) {
+	a := ops.List.Assembler()
+	pages, info, err := a.AssembleDebug("mult.vm", `
+		set   0 7
+		loop:
+		isubv 0 1
+		jumpv 0 0 loop
+		stop
+	`)
+	assert.NoError(t, err)
+	dir := t.TempDir()
+	prog := filepath.Join(dir, "mult.bin")
+	f, err := os.Create(prog)
+	assert.NoError(t, err)
+	assert.NoError(t, vm.WriteProgram(f, pages))
+	assert.NoError(t, f.Close())
+	b, err := json.Marshal(info)
+	assert.NoError(t, err)
+	infoFile := filepath.Join(dir, "mult.json")
+	assert.NoError(t, os.WriteFile(infoFile, b, 0644))
+
+	got, d, err := Load(ops.List, prog, "")
+	assert.NoError(t, err)
+	assert.Equal(t, pages, got)
+	assert.Nil(t, d)
+
+	got, d, err = Load(ops.List, prog, infoFile)
+	assert.NoError(t, err)
+	assert.Equal(t, pages, got)
+	assert.Equal(t, info, d)
+	dbg := New(vm.New(make([]vm.Qword, 1), got[0], ops.List.Ops()), ops.List, d)
+	l, err := dbg.Resolve("loop")
+	assert.NoError(t, err)
+	assert.Equal(t, Location{Page: 0, Pos: 18}, l)
+
+	_, _, err = Load(ops.List, prog, filepath.Join(dir, "missing.json"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,166 @@
+package vm
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Disassemble turns a program back into assembler text that parses to the same
+// bytes. Args marked in OpDef.Labels or OpDef.Relative that point at
+// instructions are given labels. If part of the program can not be decoded as
+// ops, from that point on it is written with #bytes.
+func Disassemble(prog []byte, ops OpList) (string, error) {
+	decode := ops.Decoder()
+	var insts []Instruction
+	var pos uint64
+	for {
+		in, ok := decode(prog, pos)
+		if !ok {
+			break
+		}
+		insts = append(insts, in)
+		pos += in.Size()
+	}
+	dataStart := int(pos)
+
+	starts := make(map[Qword]bool, len(insts)+1)
+	for _, in := range insts {
+		starts[Qword(in.Pos)] = true
+	}
+	starts[Qword(dataStart)] = true
+	labels := make(map[Qword]string)
+	for _, in := range insts {
+		for i := range in.Args {
+			if target, ok := in.target(i); ok && starts[target] {
+				labels[target] = fmt.Sprintf("L%d", target)
+			}
+		}
+	}
+
+	var b strings.Builder
+	for _, in := range insts {
+		if l, ok := labels[Qword(in.Pos)]; ok {
+			b.WriteString(l + ":\n")
+		}
+		b.WriteString("\t" + in.Def.Name)
+		for i := range in.Args {
+			b.WriteByte(' ')
+			target, ok := in.target(i)
+			if l, isLabel := labels[target]; ok && isLabel {
+				b.WriteString(l)
+			} else {
+				b.WriteString(in.formatArg(i))
+			}
+		}
+		b.WriteByte('\n')
+	}
+	if l, ok := labels[Qword(dataStart)]; ok {
+		b.WriteString(l + ":\n")
+	}
+	for pos := dataStart; pos < len(prog); pos += 16 {
+		end := pos + 16
+		if end > len(prog) {
+			end = len(prog)
+		}
+		b.WriteString("\t#bytes")
+		for _, c := range prog[pos:end] {
+			b.WriteString(" " + strconv.Itoa(int(c)))
+		}
+		b.WriteByte('\n')
+	}
+	return b.String(), nil
+}
+
+// Instruction is an op decoded from a program.
+type Instruction struct {
+	Pos  uint64
+	Op   Op
+	Def  OpDef
+	Args []Qword
+}
+
+// Size returns the number of bytes the instruction takes in the program.
+func (in Instruction) Size() uint64 {
+	return 2 + 8*uint64(len(in.Args))
+}
+
+// String returns the instruction as assembler.
+func (in Instruction) String() string {
+	words := make([]string, len(in.Args)+1)
+	words[0] = in.Def.Name
+	for i := range in.Args {
+		words[i+1] = in.formatArg(i)
+	}
+	return strings.Join(words, " ")
+}
+
+func (in Instruction) formatArg(i int) string {
+	if in.Def.Args[i] {
+		return strconv.FormatUint(uint64(in.Args[i]), 10)
+	}
+	return FormatValue(in.Args[i])
+}
+
+// target returns the position an arg points at if it is marked in Labels or
+// Relative.
+func (in Instruction) target(i int) (Qword, bool) {
+	if i < len(in.Def.Relative) && in.Def.Relative[i] {
+		return Qword(in.Pos) + in.Args[i], true
+	}
+	return in.Args[i], i < len(in.Def.Labels) && in.Def.Labels[i]
+}
+
+// Decoder returns a function that decodes the op at pos in a program. It
+// returns false if there is not a known op at pos or the program ends before
+// the args.
+func (os OpList) Decoder() func(prog []byte, pos uint64) (Instruction, bool) {
+	byIdx := make(map[Op]OpDef, len(os))
+	os.each(func(idx Op, op OpDef) {
+		byIdx[idx] = op
+	})
+	return func(prog []byte, pos uint64) (Instruction, bool) {
+		if pos+2 > uint64(len(prog)) || pos+2 < pos {
+			return Instruction{}, false
+		}
+		op := GetOp(&prog[pos])
+		def, ok := byIdx[op]
+		if !ok || pos+2+8*uint64(len(def.Args)) > uint64(len(prog)) {
+			return Instruction{}, false
+		}
+		in := Instruction{
+			Pos:  pos,
+			Op:   op,
+			Def:  def,
+			Args: make([]Qword, len(def.Args)),
+		}
+		for i := range in.Args {
+			in.Args[i] = Get(&prog[pos+2+8*uint64(i)])
+		}
+		return in, true
+	}
+}
+
+// FormatValue writes a value so that it parses back to the same Qword. Values
+// that look like floats are written as floats and small negative integers are
+// written with a sign.
+func FormatValue(q Qword) string {
+	if i := int64(q); i < 0 && i >= math.MinInt32 {
+		return strconv.FormatInt(i, 10)
+	}
+	if q >= 1<<52 {
+		f := q.GetF()
+		a := math.Abs(f)
+		if a >= 1e-6 && a < 1e15 {
+			s := strconv.FormatFloat(f, 'f', -1, 64)
+			if len(s) <= 20 {
+				if !strings.Contains(s, ".") {
+					s += ".0"
+				}
+				return s
+			}
+		}
+	}
+	return strconv.FormatUint(uint64(q), 10)
+}
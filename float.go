@@ -0,0 +1,20 @@
+package vm
+
+import (
+	"math"
+)
+
+// CanonicalNaN is the only NaN a VM with StrictFloat produces, a quiet NaN
+// with the sign bit clear and no payload.
+const CanonicalNaN Qword = 0x7ff8000000000000
+
+// Float converts the result of a floating point op to a Qword. Ops should use
+// it rather than QwordF so that StrictFloat is honoured. With StrictFloat any
+// NaN becomes CanonicalNaN, hardware differs in the sign and payload of the
+// NaNs it produces.
+func (vm *VM) Float(f float64) Qword {
+	if vm.StrictFloat && math.IsNaN(f) {
+		return CanonicalNaN
+	}
+	return QwordF(f)
+}
@@ -0,0 +1,177 @@
+package vm
+
+import (
+	"strings"
+)
+
+// Format returns the source in a canonical form. Labels start at the beginning
+// of the line, everything else is indented by a tab with an extra tab inside
+// macros. Within a block of lines that is not broken by a blank line the names
+// of ops and directives are aligned, as are trailing comments. Args are aligned
+// for runs of ops or runs of the same directive. Directive names are lower
+// cased and runs of blank lines are reduced to one. Comments that start at the
+// beginning of a line are left there. Formatting formatted source does not
+// change it.
+func Format(src string) string {
+	var lines []fmtLine
+	depth := 0
+	for _, raw := range strings.Split(src, "\n") {
+		l := fmtLine{
+			raw: strings.TrimSpace(raw),
+		}
+		l.words, l.comment = lexWords(l.raw)
+		l.topComment = len(l.words) == 0 && l.comment != "" &&
+			len(raw) > 0 && raw[0] != ' ' && raw[0] != '\t'
+		if len(l.words) > 0 && l.words[0][0] == '#' {
+			l.words[0] = strings.ToLower(l.words[0])
+		}
+		if len(l.words) > 0 && l.words[0] == "#endmacro" && depth > 0 {
+			depth--
+		}
+		l.depth = depth
+		if len(l.words) > 0 && l.words[0] == "#macro" {
+			depth++
+		}
+		lines = append(lines, l)
+	}
+
+	var b strings.Builder
+	for start := 0; start < len(lines); {
+		if lines[start].blank() {
+			start++
+			continue
+		}
+		end := start
+		for end < len(lines) && !lines[end].blank() {
+			end++
+		}
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		formatBlock(&b, lines[start:end])
+		start = end
+	}
+	return b.String()
+}
+
+type fmtLine struct {
+	raw        string
+	words      []string
+	comment    string
+	depth      int
+	topComment bool
+}
+
+func (l fmtLine) blank() bool {
+	return len(l.words) == 0 && l.comment == ""
+}
+
+func (l fmtLine) isLabel() bool {
+	return len(l.words) > 0 && strings.HasSuffix(l.words[0], ":")
+}
+
+// kind groups lines for aligning args, each directive is its own kind and
+// all ops are the same kind.
+func (l fmtLine) kind() string {
+	if l.words[0][0] == '#' {
+		return l.words[0]
+	}
+	return "op"
+}
+
+// aligned is false for lines that are not aligned in columns.
+func (l fmtLine) aligned() bool {
+	return len(l.words) > 0 && !l.isLabel() && l.words[0] != "#macro" && l.words[0] != "#endmacro"
+}
+
+func formatBlock(b *strings.Builder, lines []fmtLine) {
+	var nameWidth int
+	for _, l := range lines {
+		if l.aligned() && len(l.words[0]) > nameWidth {
+			nameWidth = len(l.words[0])
+		}
+	}
+
+	// argWidths[i] holds the width of the args for the run of lines of the
+	// same kind that lines[i] belongs to.
+	argWidths := make([][]int, len(lines))
+	for start := 0; start < len(lines); {
+		if !lines[start].aligned() {
+			start++
+			continue
+		}
+		kind := lines[start].kind()
+		var widths []int
+		end := start
+		for ; end < len(lines); end++ {
+			l := lines[end]
+			if !l.aligned() {
+				if len(l.words) > 0 && !l.isLabel() {
+					break
+				}
+				continue
+			}
+			if l.kind() != kind {
+				break
+			}
+			for i, w := range l.words[1:] {
+				if i == len(widths) {
+					widths = append(widths, 0)
+				}
+				if len(w) > widths[i] {
+					widths[i] = len(w)
+				}
+			}
+			argWidths[end] = widths
+		}
+		start = end
+	}
+
+	code := make([]string, len(lines))
+	var commentCol int
+	for i, l := range lines {
+		indent := strings.Repeat("\t", l.depth+1)
+		switch {
+		case len(l.words) == 0:
+			if !l.topComment {
+				code[i] = indent
+			}
+		case l.isLabel():
+			code[i] = indent[1:] + strings.Join(l.words, " ")
+		case !l.aligned():
+			code[i] = indent + strings.Join(l.words, " ")
+		default:
+			code[i] = indent + alignWords(l.words, nameWidth, argWidths[i])
+		}
+		if len(l.words) > 0 && l.comment != "" && len(code[i]) > commentCol {
+			commentCol = len(code[i])
+		}
+	}
+
+	for i, l := range lines {
+		b.WriteString(code[i])
+		if l.comment != "" {
+			if len(l.words) > 0 {
+				b.WriteString(strings.Repeat(" ", commentCol-len(code[i])+1))
+			}
+			b.WriteString(l.comment)
+		}
+		b.WriteByte('\n')
+	}
+}
+
+func alignWords(words []string, nameWidth int, argWidths []int) string {
+	var b strings.Builder
+	for i, w := range words {
+		b.WriteString(w)
+		if i == len(words)-1 {
+			break
+		}
+		width := nameWidth
+		if i > 0 {
+			width = argWidths[i-1]
+		}
+		b.WriteString(strings.Repeat(" ", width-len(w)+1))
+	}
+	return b.String()
+}
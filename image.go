@@ -0,0 +1,71 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+const programMagic = "vmprg1"
+
+// ErrNotProgram is returned by ReadProgram if the data is not a program
+var ErrNotProgram = errors.New("not a VM program")
+
+// WriteProgram writes the pages of a program to w so they can be read with
+// ReadProgram.
+func WriteProgram(w io.Writer, pages [][]byte) error {
+	buf := []byte(programMagic)
+	buf = binary.AppendUvarint(buf, uint64(len(pages)))
+	for _, page := range pages {
+		buf = binary.AppendUvarint(buf, uint64(len(page)))
+		buf = append(buf, page...)
+	}
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadProgram reads the pages of a program written by WriteProgram.
+func ReadProgram(r io.Reader) ([][]byte, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(programMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != programMagic {
+		return nil, ErrNotProgram
+	}
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return nil, err
+	}
+	var pages [][]byte
+	for i := uint64(0); i < n; i++ {
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, err
+		}
+		page, err := readPage(br, size)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, page)
+	}
+	return pages, nil
+}
+
+// readPage reads a page of size bytes. The page grows as it is read rather
+// than being allocated up front, so a corrupt size is an error rather than a
+// panic or a huge allocation.
+func readPage(r io.Reader, size uint64) ([]byte, error) {
+	if size > math.MaxInt64 {
+		return nil, ErrNotProgram
+	}
+	buf := bytes.NewBuffer([]byte{})
+	if _, err := io.CopyN(buf, r, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,41 @@
+package vm
+
+import (
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// include handles `#include "path"`. The path is relative to the directory of
+// the including file.
+func (p *programmer) include(line lexedLine, stack []string) error {
+	if len(line.word) != 2 {
+		return line.Error("Wrong number of arguments")
+	}
+	if p.fs == nil {
+		return line.Error("No FS for #include")
+	}
+	name, err := strconv.Unquote(line.word[1])
+	if err != nil || !strings.HasPrefix(line.word[1], `"`) {
+		return line.Error("Include path must be a quoted string")
+	}
+	if strings.HasPrefix(name, "/") {
+		name = strings.TrimLeft(name, "/")
+	} else {
+		name = path.Join(path.Dir(line.file), name)
+	}
+	if !fs.ValidPath(name) {
+		return line.Error("Bad include path")
+	}
+	for i, f := range stack {
+		if f == name {
+			return line.Error("Include cycle: " + strings.Join(append(stack[i:], name), " -> "))
+		}
+	}
+	code, err := fs.ReadFile(p.fs, name)
+	if err != nil {
+		return line.Error(err.Error())
+	}
+	return p.lex(name, string(code), stack)
+}
@@ -0,0 +1,155 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// LinkError lists the problems found while linking. Each entry is the symbol
+// name followed by the objects involved.
+type LinkError struct {
+	Unresolved []string
+	Duplicate  []string
+	Invalid    []string
+}
+
+// Error fulfils the error interface
+func (le LinkError) Error() string {
+	var parts []string
+	if len(le.Unresolved) > 0 {
+		parts = append(parts, "unresolved symbols: "+strings.Join(le.Unresolved, ", "))
+	}
+	if len(le.Duplicate) > 0 {
+		parts = append(parts, "duplicate symbols: "+strings.Join(le.Duplicate, ", "))
+	}
+	if len(le.Invalid) > 0 {
+		parts = append(parts, "page of value that is not a label: "+strings.Join(le.Invalid, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+func (le LinkError) empty() bool {
+	return len(le.Unresolved) == 0 && len(le.Duplicate) == 0 && len(le.Invalid) == 0
+}
+
+type linker struct {
+	objs   []*Object
+	pages  [][]byte
+	pageOf map[string]int
+	// bases[i][j] is the offset of section j of object i in its page
+	bases [][]int
+}
+
+// Link combines objects into a program. Sections with the same name are placed
+// one after another in the same page in the order the objects are given, each
+// padded with zeros to its Align. The unnamed sections make up page 0. Each
+// object can use its own symbols and the symbols exported by any other object.
+func Link(objs ...*Object) ([][]byte, error) {
+	for _, o := range objs {
+		if !o.valid() {
+			return nil, ErrBadObject
+		}
+	}
+	l := &linker{
+		objs:   objs,
+		pages:  [][]byte{nil},
+		pageOf: map[string]int{"": 0},
+		bases:  make([][]int, len(objs)),
+	}
+	l.layout()
+
+	type export struct {
+		obj int
+		sym Symbol
+	}
+	var le LinkError
+	exports := make(map[string]export)
+	for i, o := range objs {
+		for _, s := range o.Symbols {
+			if !s.Export {
+				continue
+			}
+			if prev, ok := exports[s.Name]; ok {
+				le.Duplicate = append(le.Duplicate, fmt.Sprintf("%s (%s, %s)", s.Name, objs[prev.obj].Name, o.Name))
+				continue
+			}
+			exports[s.Name] = export{obj: i, sym: s}
+		}
+	}
+
+	for i, o := range objs {
+		local := make(map[string]Symbol, len(o.Symbols))
+		for _, s := range o.Symbols {
+			local[s.Name] = s
+		}
+		unresolved := make(map[string]bool)
+		for _, r := range o.Relocs {
+			sym, obj := local[r.Symbol], i
+			if _, ok := local[r.Symbol]; !ok {
+				e, ok := exports[r.Symbol]
+				if !ok {
+					unresolved[r.Symbol] = true
+					continue
+				}
+				sym, obj = e.sym, e.obj
+			}
+			val, ok := l.value(obj, sym, r.Page)
+			if !ok {
+				le.Invalid = append(le.Invalid, fmt.Sprintf("%s (%s)", r.Symbol, o.Name))
+				continue
+			}
+			page := l.pageOf[o.Sections[r.Section].Name]
+			val.Put(&l.pages[page][l.bases[i][r.Section]+r.Pos])
+		}
+		for name := range unresolved {
+			le.Unresolved = append(le.Unresolved, fmt.Sprintf("%s (%s)", name, o.Name))
+		}
+	}
+
+	if !le.empty() {
+		sort.Strings(le.Unresolved)
+		sort.Strings(le.Duplicate)
+		sort.Strings(le.Invalid)
+		return nil, le
+	}
+	return l.pages, nil
+}
+
+func (l *linker) layout() {
+	for i, o := range l.objs {
+		l.bases[i] = make([]int, len(o.Sections))
+		for j, s := range o.Sections {
+			page, ok := l.pageOf[s.Name]
+			if !ok {
+				page = len(l.pages)
+				l.pageOf[s.Name] = page
+				l.pages = append(l.pages, nil)
+			}
+			if s.Align > 1 {
+				if r := len(l.pages[page]) % s.Align; r != 0 {
+					l.pages[page] = append(l.pages[page], make([]byte, s.Align-r)...)
+				}
+			}
+			l.bases[i][j] = len(l.pages[page])
+			l.pages[page] = append(l.pages[page], s.Data...)
+		}
+	}
+}
+
+// value returns the linked value of a symbol from object obj. If page is true
+// the page of the symbol is returned, which is only valid for labels.
+func (l *linker) value(obj int, s Symbol, page bool) (Qword, bool) {
+	switch s.Kind {
+	case SymbolLabel:
+		sec := l.objs[obj].Sections[s.Section]
+		if page {
+			return Qword(l.pageOf[sec.Name]), true
+		}
+		return Qword(l.bases[obj][s.Section]) + s.Value, true
+	case SymbolSection:
+		sec := l.objs[obj].Sections[s.Section]
+		return Qword(l.pageOf[sec.Name]), !page
+	}
+	return s.Value, !page
+}
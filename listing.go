@@ -0,0 +1,109 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+)
+
+// maxListedBytes limits how many bytes are shown for a single line of the
+// listing.
+const maxListedBytes = 32
+
+type listedLine struct {
+	line       lexedLine
+	page       int
+	start, end int
+}
+
+// Listing assembles the code and returns a listing showing each line with the
+// page and position it was placed at, the bytes it produced and, for ops and
+// #qword, the values of the args once labels and definitions are resolved.
+func (a *Assembler) Listing(name, code string) (string, error) {
+	p := a.programmer()
+	if err := p.lex(name, code, nil); err != nil {
+		return "", err
+	}
+	if err := p.parse(); err != nil {
+		return "", err
+	}
+	if err := p.resolve(); err != nil {
+		return "", err
+	}
+	return p.listing(), nil
+}
+
+func (p *programmer) listing() string {
+	var b strings.Builder
+	w := tabwriter.NewWriter(&b, 0, 8, 2, ' ', 0)
+	var width int
+	for _, l := range p.listed {
+		if len(l.line.raw) > width {
+			width = len(l.line.raw)
+		}
+	}
+	for _, l := range p.listed {
+		data := p.pages[l.page][l.start:l.end]
+		fmt.Fprintf(w, "%s\t%d:%d\t%s\t", position(l.line.file, l.line.number),
+			l.page, l.start, listedHex(data, l.line))
+		if resolved := p.resolvedLine(l.line, data); resolved != "" {
+			fmt.Fprintf(w, "%-*s  ; %s\n", width, l.line.raw, resolved)
+		} else {
+			fmt.Fprintln(w, l.line.raw)
+		}
+	}
+	w.Flush()
+	return b.String()
+}
+
+// listedHex shows the op in its own group followed by groups of 8 bytes.
+func listedHex(data []byte, line lexedLine) string {
+	var groups []string
+	if line.word[0][0] != '#' && len(data) >= 2 {
+		groups = append(groups, fmt.Sprintf("%x", data[:2]))
+		data = data[2:]
+	}
+	more := len(data) > maxListedBytes
+	if more {
+		data = data[:maxListedBytes]
+	}
+	for len(data) > 0 {
+		n := 8
+		if n > len(data) {
+			n = len(data)
+		}
+		groups = append(groups, fmt.Sprintf("%x", data[:n]))
+		data = data[n:]
+	}
+	if more {
+		groups = append(groups, "...")
+	}
+	return strings.Join(groups, " ")
+}
+
+// resolvedLine returns the line with every arg replaced by the value that was
+// written to the program. It is blank for lines other than ops and #qword and
+// for ops without args.
+func (p *programmer) resolvedLine(line lexedLine, data []byte) string {
+	name := line.word[0]
+	var args []bool
+	if op, ok := p.byName[name]; ok {
+		args = op.Args
+		data = data[2:]
+	} else if name == "#qword" {
+		args = make([]bool, len(data)/8)
+	}
+	if len(args) == 0 {
+		return ""
+	}
+	words := []string{name}
+	for i, isReg := range args {
+		q := Get(&data[i*8])
+		if isReg {
+			words = append(words, fmt.Sprint(uint64(q)))
+		} else {
+			words = append(words, FormatValue(q))
+		}
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,131 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxMacroDepth limits how deeply macros can invoke other macros. This also
+// catches macros that invoke themselves. MaxMacroExpansions limits how many
+// macro invocations are expanded in total, which catches macros that invoke
+// each other many times and would grow the program exponentially.
+const (
+	MaxMacroDepth      = 16
+	MaxMacroExpansions = 1 << 16
+)
+
+type macro struct {
+	params []string
+	body   []lexedLine
+}
+
+// expand collects "#macro name params... #endmacro" definitions and replaces
+// every invocation with the macro body. Params are replaced by the args of the
+// invocation and labels defined in the body are renamed so that each expansion
+// has its own copy.
+func (p *programmer) expand() error {
+	var out []lexedLine
+	for i := 0; i < len(p.lexed); i++ {
+		line := p.lexed[i]
+		switch line.word[0] {
+		case "#macro":
+			end, err := p.defMacro(i)
+			if err != nil {
+				return err
+			}
+			i = end
+		case "#endmacro":
+			return line.Error("#endmacro without #macro")
+		default:
+			var err error
+			out, err = p.expandLine(out, line, 0)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	p.lexed = out
+	return nil
+}
+
+// defMacro reads the macro starting at p.lexed[start] and returns the index of
+// the #endmacro line.
+func (p *programmer) defMacro(start int) (int, error) {
+	line := p.lexed[start]
+	if len(line.word) < 2 {
+		return 0, line.Error("Wrong number of arguments")
+	}
+	name := line.word[1]
+	if _, isOp := p.byName[name]; isOp {
+		return 0, line.Error("Macro name is an op")
+	}
+	if _, isMacro := p.macros[name]; isMacro {
+		return 0, line.Error("Macro is already defined")
+	}
+	m := macro{
+		params: line.word[2:],
+	}
+	for i := start + 1; i < len(p.lexed); i++ {
+		switch p.lexed[i].word[0] {
+		case "#endmacro":
+			p.macros[name] = m
+			return i, nil
+		case "#macro":
+			return 0, p.lexed[i].Error("Macro defined inside macro")
+		}
+		m.body = append(m.body, p.lexed[i])
+	}
+	return 0, line.Error("Macro missing #endmacro")
+}
+
+func (p *programmer) expandLine(out []lexedLine, line lexedLine, depth int) ([]lexedLine, error) {
+	m, ok := p.macros[line.word[0]]
+	if !ok {
+		return append(out, line), nil
+	}
+	if depth >= MaxMacroDepth {
+		return nil, line.Error("Macro nesting too deep")
+	}
+	if len(line.word)-1 != len(m.params) {
+		return nil, line.Error("Wrong number of arguments")
+	}
+	if p.expands >= MaxMacroExpansions {
+		return nil, line.Error("Too many macro expansions")
+	}
+
+	p.expands++
+	replace := make(map[string]string, len(m.params))
+	for _, b := range m.body {
+		if labelRe.MatchString(b.word[0]) {
+			label := strings.TrimSuffix(b.word[0], ":")
+			replace[label] = fmt.Sprintf("%s~%d", label, p.expands)
+		}
+	}
+	for i, param := range m.params {
+		replace[param] = line.word[i+1]
+	}
+
+	for _, b := range m.body {
+		words := make([]string, len(b.word))
+		for i, w := range b.word {
+			if r, ok := replace[w]; ok {
+				words[i] = r
+			} else if r, ok := replace[strings.TrimSuffix(w, ":")]; ok && i == 0 {
+				words[i] = r + ":"
+			} else if r, ok := replace[strings.TrimPrefix(w, "@")]; ok && w[0] == '@' {
+				words[i] = "@" + r
+			} else {
+				words[i] = w
+			}
+		}
+		b.word = words
+		call := line
+		b.call = &call
+		var err error
+		out, err = p.expandLine(out, b, depth+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,349 @@
+// Package merkle commits to the state of a VM with a Merkle tree over its
+// registers and memory so that peers can agree on a single root hash and prove
+// the value of a register or memory word without sending the whole state.
+//
+// The first leaf is the shape of the state, the number of registers and pages
+// and the length of each page, so states with different shapes can not have
+// the same root. After it the registers and then each page are split into
+// chunks and every chunk is a leaf. A leaf hash covers the chunk and where it
+// is, so a proof for one chunk can not be used for another. The leaves are
+// padded with zero hashes to a power of two.
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"github.com/dist-ribut-us/vm"
+)
+
+// Errors returned by Tree
+var (
+	ErrOutOfRange = errors.New("out of range")
+	ErrBadChunk   = errors.New("chunk size must be a positive multiple of 8")
+)
+
+// Hash is a node of the tree
+type Hash [sha256.Size]byte
+
+// DefaultChunk is the chunk size used by New.
+const DefaultChunk = 64
+
+// Tree is a Merkle tree over the registers and pages of a VM. It is a
+// vm.Tracer, while it is tracing the VM it is updated after each op from the
+// register changes and memory writes. Memory that is changed without VM.Write
+// or VM.Touch is not seen, nor is going back with VM.Back, Rebuild must be
+// called after either.
+type Tree struct {
+	VM    *vm.VM
+	Chunk uint64
+	// levels[0] holds the leaves and the last level holds the root
+	levels [][]Hash
+	// starts holds the first leaf of each page, the shape is leaf 0 and the
+	// registers start at 1
+	starts []uint64
+	sizes  []int
+	regs   int
+}
+
+// New builds a tree over the current state of v with DefaultChunk.
+func New(v *vm.VM) *Tree {
+	t, _ := NewChunk(v, DefaultChunk)
+	return t
+}
+
+// NewChunk builds a tree over the current state of v where each leaf holds
+// chunk bytes.
+func NewChunk(v *vm.VM, chunk uint64) (*Tree, error) {
+	if chunk == 0 || chunk%8 != 0 {
+		return nil, ErrBadChunk
+	}
+	t := &Tree{
+		VM:    v,
+		Chunk: chunk,
+	}
+	t.Rebuild()
+	return t, nil
+}
+
+// Root returns the root hash.
+func (t *Tree) Root() Hash {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// Rebuild builds the whole tree from the VM.
+func (t *Tree) Rebuild() {
+	v := t.VM
+	t.regs = len(v.Registers)
+	t.sizes = t.sizes[:0]
+	t.starts = t.starts[:0]
+	n := 1 + t.chunks(uint64(8*t.regs))
+	for _, p := range v.Pages {
+		t.starts = append(t.starts, n)
+		t.sizes = append(t.sizes, len(p))
+		n += t.chunks(uint64(len(p)))
+	}
+
+	width := uint64(1)
+	for width < n {
+		width *= 2
+	}
+	leaves := make([]Hash, width)
+	leaves[0] = t.shapeLeaf()
+	for i := uint64(0); i < t.chunks(uint64(8*t.regs)); i++ {
+		leaves[1+i] = t.registerLeaf(i)
+	}
+	for page := range v.Pages {
+		for i := uint64(0); i < t.chunks(uint64(t.sizes[page])); i++ {
+			leaves[t.starts[page]+i] = t.pageLeaf(uint64(page), i)
+		}
+	}
+
+	t.levels = [][]Hash{leaves}
+	for level := leaves; len(level) > 1; {
+		next := make([]Hash, len(level)/2)
+		for i := range next {
+			next[i] = node(level[2*i], level[2*i+1])
+		}
+		t.levels = append(t.levels, next)
+		level = next
+	}
+}
+
+// chunks returns the number of chunks needed for size bytes.
+func (t *Tree) chunks(size uint64) uint64 {
+	return (size + t.Chunk - 1) / t.Chunk
+}
+
+// registerChunk returns the bytes of chunk i of the registers.
+func (t *Tree) registerChunk(i uint64) []byte {
+	regs := t.VM.Registers
+	var b []byte
+	for r := i * t.Chunk / 8; r < (i+1)*t.Chunk/8 && r < uint64(len(regs)); r++ {
+		b = append(b, make([]byte, 8)...)
+		regs[r].Put(&b[len(b)-8])
+	}
+	return b
+}
+
+// pageChunk returns the bytes of chunk i of a page.
+func (t *Tree) pageChunk(page, i uint64) []byte {
+	p := t.VM.Pages[page]
+	end := (i + 1) * t.Chunk
+	if end > uint64(len(p)) {
+		end = uint64(len(p))
+	}
+	return p[i*t.Chunk : end]
+}
+
+// shapeLeaf hashes the number of registers, the number of pages and the
+// length of each page.
+func (t *Tree) shapeLeaf() Hash {
+	b := []byte{0, 0}
+	b = binary.AppendUvarint(b, uint64(t.regs))
+	b = binary.AppendUvarint(b, uint64(len(t.sizes)))
+	for _, size := range t.sizes {
+		b = binary.AppendUvarint(b, uint64(size))
+	}
+	return sha256.Sum256(b)
+}
+
+func (t *Tree) registerLeaf(i uint64) Hash {
+	return leaf(true, 0, i*t.Chunk, t.registerChunk(i))
+}
+
+func (t *Tree) pageLeaf(page, i uint64) Hash {
+	return leaf(false, page, i*t.Chunk, t.pageChunk(page, i))
+}
+
+// set changes a leaf and updates the hashes above it.
+func (t *Tree) set(idx uint64, h Hash) {
+	t.levels[0][idx] = h
+	for l := 1; l < len(t.levels); l++ {
+		idx /= 2
+		below := t.levels[l-1]
+		t.levels[l][idx] = node(below[2*idx], below[2*idx+1])
+	}
+}
+
+// changed returns true if the shape of the VM no longer matches the tree.
+func (t *Tree) changed() bool {
+	v := t.VM
+	if len(v.Registers) != t.regs || len(v.Pages) != len(t.sizes) {
+		return true
+	}
+	for i, p := range v.Pages {
+		if len(p) != t.sizes[i] {
+			return true
+		}
+	}
+	return false
+}
+
+// UpdateRegister updates the tree after register r changes.
+func (t *Tree) UpdateRegister(r uint64) {
+	i := 8 * r / t.Chunk
+	t.set(1+i, t.registerLeaf(i))
+}
+
+// UpdateMemory updates the tree after size bytes at page, pos change.
+func (t *Tree) UpdateMemory(page, pos, size uint64) {
+	if size == 0 || page >= uint64(len(t.sizes)) {
+		return
+	}
+	end := pos + size
+	if end > uint64(t.sizes[page]) {
+		end = uint64(t.sizes[page])
+	}
+	for i := pos / t.Chunk; i*t.Chunk < end; i++ {
+		t.set(t.starts[page]+i, t.pageLeaf(page, i))
+	}
+}
+
+// Before fulfils vm.Tracer
+func (t *Tree) Before(*vm.VM, *vm.TraceEvent) {}
+
+// After fulfils vm.Tracer and updates the tree with the changes made by the
+// op. If pages were added or registers or pages changed size, the whole tree
+// is rebuilt.
+func (t *Tree) After(_ *vm.VM, e *vm.TraceEvent) {
+	if t.changed() {
+		t.Rebuild()
+		return
+	}
+	for _, d := range e.Deltas {
+		t.UpdateRegister(d.Register)
+	}
+	for _, w := range e.Writes {
+		t.UpdateMemory(w.At.Page, w.At.Pos, uint64(len(w.Old)))
+	}
+}
+
+// Proof shows that Data is the chunk starting at Offset in the registers or a
+// page. Index is the leaf and Siblings are the hashes needed to get from the
+// leaf to the root.
+type Proof struct {
+	Registers bool
+	Page      uint64
+	Offset    uint64
+	Data      []byte
+	Index     uint64
+	Siblings  []Hash
+}
+
+// Root returns the root that the proof leads to.
+func (p Proof) Root() Hash {
+	h := leaf(p.Registers, p.Page, p.Offset, p.Data)
+	idx := p.Index
+	for _, s := range p.Siblings {
+		if idx%2 == 0 {
+			h = node(h, s)
+		} else {
+			h = node(s, h)
+		}
+		idx /= 2
+	}
+	return h
+}
+
+// Verify returns true if the proof leads to root.
+func (p Proof) Verify(root Hash) bool {
+	return p.Root() == root
+}
+
+func (t *Tree) proof(idx uint64) []Hash {
+	var sib []Hash
+	for l := 0; l < len(t.levels)-1; l++ {
+		sib = append(sib, t.levels[l][idx^1])
+		idx /= 2
+	}
+	return sib
+}
+
+// ProveRegister returns a proof of the chunk holding register r.
+func (t *Tree) ProveRegister(r uint64) (Proof, error) {
+	if r >= uint64(t.regs) {
+		return Proof{}, ErrOutOfRange
+	}
+	i := 8 * r / t.Chunk
+	return Proof{
+		Registers: true,
+		Offset:    i * t.Chunk,
+		Data:      t.registerChunk(i),
+		Index:     1 + i,
+		Siblings:  t.proof(1 + i),
+	}, nil
+}
+
+// ProveMemory returns proofs of the chunks holding the 8 byte word at page,
+// pos. There are two if the word crosses into the next chunk.
+func (t *Tree) ProveMemory(page, pos uint64) ([]Proof, error) {
+	if page >= uint64(len(t.sizes)) || pos+8 > uint64(t.sizes[page]) || pos+8 < pos {
+		return nil, ErrOutOfRange
+	}
+	var ps []Proof
+	for i := pos / t.Chunk; i*t.Chunk < pos+8; i++ {
+		idx := t.starts[page] + i
+		ps = append(ps, Proof{
+			Page:     page,
+			Offset:   i * t.Chunk,
+			Data:     append([]byte(nil), t.pageChunk(page, i)...),
+			Index:    idx,
+			Siblings: t.proof(idx),
+		})
+	}
+	return ps, nil
+}
+
+// VerifyRegister returns true if the proof shows register r held q under root.
+func VerifyRegister(root Hash, r uint64, q vm.Qword, p Proof) bool {
+	off := 8 * r
+	if !p.Registers || off < p.Offset || off+8 > p.Offset+uint64(len(p.Data)) {
+		return false
+	}
+	at := off - p.Offset
+	return vm.Get(&p.Data[at]) == q && p.Verify(root)
+}
+
+// VerifyMemory returns true if the proofs show the 8 bytes at page, pos held q
+// under root.
+func VerifyMemory(root Hash, page, pos uint64, q vm.Qword, ps []Proof) bool {
+	var word []byte
+	next := pos
+	for _, p := range ps {
+		if p.Registers || p.Page != page || next < p.Offset || next >= p.Offset+uint64(len(p.Data)) {
+			return false
+		}
+		if !p.Verify(root) {
+			return false
+		}
+		end := pos + 8 - p.Offset
+		if end > uint64(len(p.Data)) {
+			end = uint64(len(p.Data))
+		}
+		word = append(word, p.Data[next-p.Offset:end]...)
+		next = p.Offset + end
+	}
+	return len(word) == 8 && vm.Get(&word[0]) == q
+}
+
+// leaf hashes a chunk with where it is. Register chunks are marked with 1 and
+// page chunks with 2, the shape leaf uses 0.
+func leaf(registers bool, page, offset uint64, data []byte) Hash {
+	b := []byte{0}
+	if registers {
+		b = append(b, 1)
+	} else {
+		b = append(b, 2)
+		b = binary.AppendUvarint(b, page)
+	}
+	b = binary.AppendUvarint(b, offset)
+	return sha256.Sum256(append(b, data...))
+}
+
+func node(left, right Hash) Hash {
+	b := make([]byte, 1, 1+2*sha256.Size)
+	b[0] = 1
+	b = append(b, left[:]...)
+	return sha256.Sum256(append(b, right[:]...))
+}
@@ -0,0 +1,80 @@
+package merkle
+
+import (
+	"github.com/dist-ribut-us/vm"
+	"github.com/dist-ribut-us/vm/ops"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestTree(t *testing.T) {
+	p, err := ops.List.Parser()(`
+		set   1 4
+		set   3 100
+		alloc 3
+		set   4 60
+		loop:
+		iadd  2 0
+		write 2 3 4
+		isubv 1 1
+		jumpv 1 0 loop
+		stop
+	`)
+	assert.NoError(t, err)
+	v := vm.New(make([]vm.Qword, 5), p, ops.List.Ops())
+	v.Registers[0] = 7
+
+	tree, err := NewChunk(v, 16)
+	assert.NoError(t, err)
+	start := tree.Root()
+	v.Trace(ops.List, tree)
+	assert.NoError(t, v.Run())
+	root := tree.Root()
+	assert.NotEqual(t, start, root)
+
+	// the updated tree matches one built from scratch
+	fresh, err := NewChunk(v, 16)
+	assert.NoError(t, err)
+	assert.Equal(t, fresh.Root(), root)
+
+	rp, err := tree.ProveRegister(2)
+	assert.NoError(t, err)
+	assert.True(t, VerifyRegister(root, 2, 28, rp))
+	assert.False(t, VerifyRegister(root, 2, 27, rp))
+	assert.False(t, VerifyRegister(root, 3, 28, rp))
+	assert.False(t, VerifyRegister(start, 2, 28, rp))
+
+	// the word at 60 crosses from the chunk at 48 into the chunk at 64
+	mp, err := tree.ProveMemory(1, 60)
+	assert.NoError(t, err)
+	assert.Len(t, mp, 2)
+	assert.True(t, VerifyMemory(root, 1, 60, 28, mp))
+	assert.False(t, VerifyMemory(root, 1, 60, 21, mp))
+	assert.False(t, VerifyMemory(root, 0, 60, 28, mp))
+	assert.False(t, VerifyMemory(root, 1, 60, 28, mp[:1]))
+
+	mp, err = tree.ProveMemory(1, 8)
+	assert.NoError(t, err)
+	assert.Len(t, mp, 1)
+	assert.True(t, VerifyMemory(root, 1, 8, 0, mp))
+
+	_, err = tree.ProveMemory(1, 96)
+	assert.Equal(t, ErrOutOfRange, err)
+	_, err = tree.ProveRegister(5)
+	assert.Equal(t, ErrOutOfRange, err)
+
+	_, err = NewChunk(v, 12)
+	assert.Equal(t, ErrBadChunk, err)
+}
+
+func TestShape(t *testing.T) {
+	a := vm.New(make([]vm.Qword, 2), []byte{1, 2, 3}, nil)
+	b := vm.New(make([]vm.Qword, 2), []byte{1, 2, 3}, nil)
+	assert.Equal(t, New(a).Root(), New(b).Root())
+
+	// an empty page has no chunks but still changes the root
+	b.Pages = append(b.Pages, nil)
+	assert.NotEqual(t, New(a).Root(), New(b).Root())
+	a.Pages = append(a.Pages, nil, nil)
+	assert.NotEqual(t, New(a).Root(), New(b).Root())
+}
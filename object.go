@@ -0,0 +1,243 @@
+package vm
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/fs"
+	"sort"
+)
+
+// Object is an assembled program that has not been linked. Labels are stored
+// as offsets into their section and every place a label or section is used has
+// a relocation so the linker can write the final value.
+type Object struct {
+	Name string
+	// Sections[0] is the unnamed section that holds page 0, the rest come
+	// from #section.
+	Sections []Section
+	Symbols  []Symbol
+	// Imports are names that are used but not defined in the object.
+	Imports []string
+	Relocs  []Reloc
+}
+
+// Section is a named piece of a page. Align is a multiple of every #align
+// used in the section, the linker places the section at a multiple of it so
+// the alignment is kept. It is 0 if #align was not used.
+type Section struct {
+	Name  string
+	Data  []byte
+	Align int
+}
+
+// SymbolKind indicates what a Symbol refers to
+type SymbolKind byte
+
+// SymbolKinds
+const (
+	// SymbolValue is a number defined with #def
+	SymbolValue SymbolKind = iota
+	// SymbolLabel is a position in a section
+	SymbolLabel
+	// SymbolSection is the page number of a section
+	SymbolSection
+)
+
+// Symbol is a name defined in an Object. Only symbols with Export set can be
+// used by other objects.
+type Symbol struct {
+	Name    string
+	Kind    SymbolKind
+	Section int
+	Value   Qword
+	Export  bool
+}
+
+// Reloc is a place in a section where the value of a symbol is written by the
+// linker. If Page is true the page of the symbol is written.
+type Reloc struct {
+	Section int
+	Pos     int
+	Symbol  string
+	Page    bool
+}
+
+// Object assembles the code into an Object that can be passed to Link. Names
+// that are not defined become imports and names marked with "#export name" can
+// be used by other objects.
+func (a *Assembler) Object(name, code string) (*Object, error) {
+	p := a.programmer()
+	p.object = true
+	if err := p.lex(name, code, nil); err != nil {
+		return nil, err
+	}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	return p.toObject(name)
+}
+
+// ObjectFile reads the named file from FS and assembles it into an Object.
+func (a *Assembler) ObjectFile(name string) (*Object, error) {
+	if a.FS == nil {
+		return nil, errNoFS
+	}
+	code, err := fs.ReadFile(a.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	return a.Object(name, string(code))
+}
+
+// export handles "#export name" which allows other objects to use name.
+func (p *programmer) export(line lexedLine) error {
+	if len(line.word) != 2 {
+		return line.Error("Wrong number of arguments")
+	}
+	name := line.word[1]
+	if !isName(name) || name[0] == '.' {
+		return line.Error("Export must be a name")
+	}
+	if _, ok := p.exports[name]; ok {
+		return line.Error("Already exported")
+	}
+	p.exports[name] = line
+	return nil
+}
+
+func (p *programmer) toObject(name string) (*Object, error) {
+	o := &Object{
+		Name:     name,
+		Sections: make([]Section, len(p.pages)),
+	}
+	for i, page := range p.pages {
+		o.Sections[i].Data = page
+		o.Sections[i].Align = p.aligns[i]
+	}
+	for sName, page := range p.sections {
+		o.Sections[page].Name = sName
+	}
+
+	for _, n := range p.varNames() {
+		v := p.vars[n]
+		if !v.defined {
+			o.Imports = append(o.Imports, n)
+		} else {
+			s := Symbol{
+				Name:  n,
+				Value: v.value,
+			}
+			_, s.Export = p.exports[n]
+			switch {
+			case v.label:
+				s.Kind = SymbolLabel
+				s.Section = int(v.page)
+			case v.section:
+				s.Kind = SymbolSection
+				s.Section = int(v.value)
+			}
+			o.Symbols = append(o.Symbols, s)
+		}
+
+		for _, f := range v.instance {
+			if f.reg && (v.label || v.section) {
+				return nil, f.line.Error("Label used as register")
+			}
+			if f.isPage && v.defined && !v.label {
+				return nil, f.line.Error("Page of value that is not a label")
+			}
+			if f.rel {
+				// the distance within a section does not change when it is
+				// linked
+				if !v.defined {
+					return nil, f.line.Error("Relative label in another page")
+				}
+				val, err := f.relative(v)
+				if err != nil {
+					return nil, err
+				}
+				val.Put(&(o.Sections[f.page].Data[f.pos]))
+				continue
+			}
+			if v.defined && !v.label && !v.section {
+				v.value.Put(&(o.Sections[f.page].Data[f.pos]))
+				continue
+			}
+			o.Relocs = append(o.Relocs, Reloc{
+				Section: f.page,
+				Pos:     f.pos,
+				Symbol:  n,
+				Page:    f.isPage,
+			})
+		}
+	}
+	sort.Slice(o.Relocs, func(i, j int) bool {
+		ri, rj := o.Relocs[i], o.Relocs[j]
+		if ri.Section != rj.Section {
+			return ri.Section < rj.Section
+		}
+		return ri.Pos < rj.Pos
+	})
+	return o, nil
+}
+
+const objectMagic = "vmobj1"
+
+// ErrNotObject is returned by DecodeObject if the data is not an Object
+var ErrNotObject = errors.New("not a VM object")
+
+// ErrBadObject is returned by DecodeObject and Link if a relocation or symbol
+// refers to a section or position that does not exist.
+var ErrBadObject = errors.New("object refers to a section or position that does not exist")
+
+// Encode writes the Object to w.
+func (o *Object) Encode(w io.Writer) error {
+	if _, err := io.WriteString(w, objectMagic); err != nil {
+		return err
+	}
+	return gob.NewEncoder(w).Encode(o)
+}
+
+// DecodeObject reads an Object written by Encode.
+func DecodeObject(r io.Reader) (*Object, error) {
+	magic := make([]byte, len(objectMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != objectMagic {
+		return nil, ErrNotObject
+	}
+	o := &Object{}
+	if err := gob.NewDecoder(r).Decode(o); err != nil {
+		return nil, err
+	}
+	if !o.valid() {
+		return nil, ErrBadObject
+	}
+	return o, nil
+}
+
+// valid returns false if a relocation or symbol refers to a section or
+// position that does not exist, or a section has a negative Align.
+func (o *Object) valid() bool {
+	for _, s := range o.Sections {
+		if s.Align < 0 {
+			return false
+		}
+	}
+	for _, r := range o.Relocs {
+		if r.Section < 0 || r.Section >= len(o.Sections) {
+			return false
+		}
+		if r.Pos < 0 || r.Pos > len(o.Sections[r.Section].Data)-8 {
+			return false
+		}
+	}
+	for _, s := range o.Symbols {
+		if s.Kind != SymbolLabel && s.Kind != SymbolSection {
+			continue
+		}
+		if s.Section < 0 || s.Section >= len(o.Sections) {
+			return false
+		}
+	}
+	return true
+}
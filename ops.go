@@ -22,13 +22,22 @@ type OpFunc func(*VM) error
 // OpDef is a tool for defining ops for the VM. Func must be either an OpFunc,
 // ArgFunc or ArgFuncErr. Args takes a slice of bools where true indicates a
 // register arg and false indicates a value. The length is used for ArgFunc and
-// ArgFuncErr and the boolean values are only used for the description.
+// ArgFuncErr and the boolean values are used for the description and by the
+// parser to check register aliases. Ops that change memory should use VM.Write
+// or VM.Touch so the change can be undone.
 type OpDef struct {
 	Name string
 	Desc string
 	Func interface{}
 	Args []bool
 	Idx  Op
+	// Labels marks the args that hold a position in the program, this is used
+	// by the disassembler to turn them back into labels. It can be left nil.
+	Labels []bool
+	// Relative marks the args that hold a position relative to the start of
+	// the op. When a label is used for one, the assembler writes the distance
+	// to it, so the label must be in the same page. It can be left nil.
+	Relative []bool
 }
 
 // OpFunc produces an OpFunc from an OpDef
@@ -75,7 +84,7 @@ func argFunc(fn ArgFunc, boolArgs []bool) OpFunc {
 
 // ArgFuncErr is helpful in defining OpFuncs from OpDefs, the args will be
 // passed in as a slice of QWords. If it returns an error, that will be returned
-// from the OpFunc.
+// from the OpFunc and Pos is left on the op so the error can be located.
 type ArgFuncErr func([]Qword, *VM) error
 
 func argFuncErr(fn ArgFuncErr, boolArgs []bool) OpFunc {
@@ -84,9 +93,11 @@ func argFuncErr(fn ArgFuncErr, boolArgs []bool) OpFunc {
 		for i := range args {
 			args[i] = Get(&vm.Pages[vm.Page][vm.Pos+2+uint64(i)*8])
 		}
-		err := fn(args, vm)
+		if err := fn(args, vm); err != nil {
+			return err
+		}
 		vm.Pos += 2 + 8*uint64(len(boolArgs))
-		return err
+		return nil
 	}
 }
 
@@ -122,6 +133,15 @@ type OpList []OpDef
 // Ops returns a slice of OpFuncs. The slice will always be 65,536 long.
 func (os OpList) Ops() []OpFunc {
 	ops := make([]OpFunc, 65536)
+	os.each(func(idx Op, op OpDef) {
+		ops[idx] = op.OpFunc()
+	})
+	return ops
+}
+
+// each calls fn with every op and its index. Ops are numbered from 1 unless
+// Idx is set, which also sets the start for the ops that follow.
+func (os OpList) each(fn func(Op, OpDef)) {
 	var idx Op
 	for _, op := range os {
 		if op.Idx != 0 {
@@ -129,9 +149,8 @@ func (os OpList) Ops() []OpFunc {
 		} else {
 			idx++
 		}
-		ops[idx] = op.OpFunc()
+		fn(idx, op)
 	}
-	return ops
 }
 
 // Describe returns a description of all the ops
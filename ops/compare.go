@@ -0,0 +1,75 @@
+package ops
+
+import (
+	"github.com/dist-ribut-us/vm"
+)
+
+// cond compares two register values
+type cond func(a, b vm.Qword) bool
+
+func eq(a, b vm.Qword) bool  { return a == b }
+func ne(a, b vm.Qword) bool  { return a != b }
+func lt(a, b vm.Qword) bool  { return int64(a) < int64(b) }
+func le(a, b vm.Qword) bool  { return int64(a) <= int64(b) }
+func ltu(a, b vm.Qword) bool { return a < b }
+func leu(a, b vm.Qword) bool { return a <= b }
+func feq(a, b vm.Qword) bool { return a.GetF() == b.GetF() }
+func flt(a, b vm.Qword) bool { return a.GetF() < b.GetF() }
+func fle(a, b vm.Qword) bool { return a.GetF() <= b.GetF() }
+
+// swap reverses the args of a cond, so lt becomes greater than.
+func swap(c cond) cond {
+	return func(a, b vm.Qword) bool { return c(b, a) }
+}
+
+// compare defines an op that sets R0 to 1 if c(R1, R2) is true and 0 if not,
+// test describes the comparison.
+func compare(name, test string, c cond) vm.OpDef {
+	return vm.OpDef{
+		Name: name,
+		Desc: "set R0 to 1 if " + test + ", otherwise 0",
+		Func: func(args []vm.Qword, v *vm.VM) {
+			var q vm.Qword
+			if c(v.Registers[args[1]], v.Registers[args[2]]) {
+				q = 1
+			}
+			v.Registers[args[0]] = q
+		},
+		Args: []bool{true, true, true},
+	}
+}
+
+// branch defines an op that jumps to page V0, position V1 if c(R0, R1) is
+// true, test describes the comparison.
+func branch(name, test string, c cond) vm.OpDef {
+	return vm.OpDef{
+		Name: name,
+		Desc: "if " + test + ", it will jump to page V0, position V1",
+		Func: func(v *vm.VM) error {
+			page := v.Pages[v.Page]
+			a := v.Registers[vm.Get(&page[v.Pos+2])]
+			b := v.Registers[vm.Get(&page[v.Pos+10])]
+			if !c(a, b) {
+				v.Pos += 2 + 8*4
+				return nil
+			}
+			v.Page = vm.Get(&page[v.Pos+18]).GetU()
+			v.Pos = vm.Get(&page[v.Pos+26]).GetU()
+			return nil
+		},
+		Args:   []bool{true, true, false, false},
+		Labels: []bool{false, false, false, true},
+	}
+}
+
+// relBranch moves Pos by the value arg if the register arg passes test,
+// otherwise it moves on to the next op.
+func relBranch(v *vm.VM, test func(vm.Qword) bool) error {
+	page := v.Pages[v.Page]
+	if !test(v.Registers[vm.Get(&page[v.Pos+2])]) {
+		v.Pos += 2 + 8*2
+		return nil
+	}
+	v.Pos += vm.Get(&page[v.Pos+10]).GetU()
+	return nil
+}
@@ -0,0 +1,51 @@
+package ops
+
+import (
+	"github.com/dist-ribut-us/vm"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"testing"
+)
+
+// TestStrictFloat checks the exact bits of float results that are known to
+// differ between hardware or compilers if they are not handled.
+func TestStrictFloat(t *testing.T) {
+	f := vm.QwordF
+	minSub := vm.Qword(1)
+	testCases := []struct {
+		name     string
+		code     string
+		a, b     vm.Qword
+		expected vm.Qword
+	}{
+		{"add", "fadd 0 1", f(0.1), f(0.2), 0x3fd3333333333334},
+		{"tie to even down", "fadd 0 1", f(1), f(0x1p-53), 0x3ff0000000000000},
+		{"tie to even up", "fadd 0 1", f(1 + 0x1p-52), f(0x1p-53), 0x3ff0000000000002},
+		{"negative zero", "fadd 0 1", f(math.Copysign(0, -1)), f(math.Copysign(0, -1)), 0x8000000000000000},
+		{"zero minus zero", "fsub 0 1", f(0), f(0), 0},
+		{"overflow", "fmul 0 1", f(1e308), f(10), 0x7ff0000000000000},
+		{"subnormal tie", "fmul 0 1", minSub, f(0.5), 0},
+		{"subnormal round", "fmul 0 1", minSub, f(1.5), 2},
+		{"inf minus inf", "fsub 0 1", f(math.Inf(1)), f(math.Inf(1)), vm.CanonicalNaN},
+		{"zero times inf", "fmul 0 1", f(0), f(math.Inf(-1)), vm.CanonicalNaN},
+		{"nan payload", "fadd 0 1", 0xfff8000000000123, f(1), vm.CanonicalNaN},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := List.Parser()(tc.code + "\nstop")
+			assert.NoError(t, err)
+			v := vm.New([]vm.Qword{tc.a, tc.b}, p, List.Ops())
+			v.StrictFloat = true
+			assert.NoError(t, v.Run())
+			assert.Equal(t, tc.expected, v.Registers[0])
+
+			v = vm.New([]vm.Qword{tc.a, tc.b}, p, List.Ops())
+			assert.NoError(t, v.Run())
+			if tc.expected == vm.CanonicalNaN {
+				assert.True(t, math.IsNaN(v.Registers[0].GetF()))
+			} else {
+				assert.Equal(t, tc.expected, v.Registers[0])
+			}
+		})
+	}
+}
@@ -5,6 +5,11 @@ import (
 	"github.com/dist-ribut-us/vm"
 )
 
+// Sets holds the named op lists that tools like vmasm can choose from.
+var Sets = map[string]vm.OpList{
+	"default": List,
+}
+
 // List holds
 var List = vm.OpList{
 	{
@@ -37,7 +42,7 @@ var List = vm.OpList{
 		Func: func(args []vm.Qword, v *vm.VM) {
 			v.Registers[args[0]] += args[1]
 		},
-		Args: []bool{true, true},
+		Args: []bool{true, false},
 	},
 	{
 		Name: "isub",
@@ -53,7 +58,7 @@ var List = vm.OpList{
 		Func: func(args []vm.Qword, v *vm.VM) {
 			v.Registers[args[0]] -= args[1]
 		},
-		Args: []bool{true, true},
+		Args: []bool{true, false},
 	},
 	{
 		Name: "imul",
@@ -69,14 +74,13 @@ var List = vm.OpList{
 		Func: func(args []vm.Qword, v *vm.VM) {
 			v.Registers[args[0]] *= args[1]
 		},
-		Args: []bool{true, true},
+		Args: []bool{true, false},
 	},
 	{
 		Name: "fadd",
 		Desc: "set R0 to R0+R1 treating both as floating point numbers",
 		Func: func(args []vm.Qword, v *vm.VM) {
-			f := v.Registers[args[0]].GetF() + v.Registers[args[1]].GetF()
-			v.Registers[args[0]] = vm.QwordF(f)
+			v.Registers[args[0]] = v.Float(v.Registers[args[0]].GetF() + v.Registers[args[1]].GetF())
 		},
 		Args: []bool{true, true},
 	},
@@ -84,17 +88,15 @@ var List = vm.OpList{
 		Name: "faddv",
 		Desc: "set R0 to R0+V0 treating both as floating point numbers",
 		Func: func(args []vm.Qword, v *vm.VM) {
-			f := v.Registers[args[0]].GetF() + args[1].GetF()
-			v.Registers[args[0]] = vm.QwordF(f)
+			v.Registers[args[0]] = v.Float(v.Registers[args[0]].GetF() + args[1].GetF())
 		},
-		Args: []bool{true, true},
+		Args: []bool{true, false},
 	},
 	{
 		Name: "fsub",
 		Desc: "set R0 to R0-R1 treating both as floating point numbers",
 		Func: func(args []vm.Qword, v *vm.VM) {
-			f := v.Registers[args[0]].GetF() - v.Registers[args[1]].GetF()
-			v.Registers[args[0]] = vm.QwordF(f)
+			v.Registers[args[0]] = v.Float(v.Registers[args[0]].GetF() - v.Registers[args[1]].GetF())
 		},
 		Args: []bool{true, true},
 	},
@@ -102,17 +104,15 @@ var List = vm.OpList{
 		Name: "fsubv",
 		Desc: "set R0 to R0-V0 treating both as floating point numbers",
 		Func: func(args []vm.Qword, v *vm.VM) {
-			f := v.Registers[args[0]].GetF() - args[1].GetF()
-			v.Registers[args[0]] = vm.QwordF(f)
+			v.Registers[args[0]] = v.Float(v.Registers[args[0]].GetF() - args[1].GetF())
 		},
-		Args: []bool{true, true},
+		Args: []bool{true, false},
 	},
 	{
 		Name: "fmul",
 		Desc: "set R0 to R0*R1 treating both as floating point numbers",
 		Func: func(args []vm.Qword, v *vm.VM) {
-			f := v.Registers[args[0]].GetF() * v.Registers[args[1]].GetF()
-			v.Registers[args[0]] = vm.QwordF(f)
+			v.Registers[args[0]] = v.Float(v.Registers[args[0]].GetF() * v.Registers[args[1]].GetF())
 		},
 		Args: []bool{true, true},
 	},
@@ -120,18 +120,20 @@ var List = vm.OpList{
 		Name: "fmulv",
 		Desc: "set R0 to R0*V0 treating both as floating point numbers",
 		Func: func(args []vm.Qword, v *vm.VM) {
-			f := v.Registers[args[0]].GetF() * args[1].GetF()
-			v.Registers[args[0]] = vm.QwordF(f)
+			v.Registers[args[0]] = v.Float(v.Registers[args[0]].GetF() * args[1].GetF())
 		},
-		Args: []bool{true, true},
+		Args: []bool{true, false},
 	},
 	{
 		Name: "alloc",
 		Desc: "allocates a new page with a size of R0 then sets R0 to the page number",
-		Func: func(args []vm.Qword, v *vm.VM) {
-			size := v.Registers[args[0]]
-			v.Registers[args[0]] = vm.Qword(len(v.Pages))
-			v.Pages = append(v.Pages, make([]byte, size))
+		Func: func(args []vm.Qword, v *vm.VM) error {
+			page, err := v.Alloc(v.Registers[args[0]].GetU())
+			if err != nil {
+				return err
+			}
+			v.Registers[args[0]] = vm.Qword(page)
+			return nil
 		},
 		Args: []bool{true},
 	},
@@ -151,7 +153,7 @@ var List = vm.OpList{
 		Func: func(args []vm.Qword, v *vm.VM) {
 			page := v.Registers[args[1]]
 			pos := v.Registers[args[2]]
-			v.Registers[args[0]].Put(&v.Pages[page][pos])
+			v.Write(page.GetU(), pos.GetU(), v.Registers[args[0]])
 		},
 		Args: []bool{true, true, true},
 	},
@@ -183,11 +185,13 @@ var List = vm.OpList{
 				v.Pos += 2 + 8*3
 				return nil
 			}
-			v.Page = vm.Get(&v.Pages[v.Page][v.Pos+10]).GetU()
+			page := vm.Get(&v.Pages[v.Page][v.Pos+10]).GetU()
 			v.Pos = vm.Get(&v.Pages[v.Page][v.Pos+18]).GetU()
+			v.Page = page
 			return nil
 		},
-		Args: []bool{true, false, false},
+		Args:   []bool{true, false, false},
+		Labels: []bool{false, false, true},
 	},
 	{
 		Name: "position",
@@ -198,6 +202,111 @@ var List = vm.OpList{
 		},
 		Args: []bool{true, true},
 	},
+	compare("eq", "R1 == R2", eq),
+	compare("ne", "R1 != R2", ne),
+	compare("lt", "R1 < R2 as signed integers", lt),
+	compare("le", "R1 <= R2 as signed integers", le),
+	compare("ltu", "R1 < R2 as unsigned integers", ltu),
+	compare("leu", "R1 <= R2 as unsigned integers", leu),
+	compare("feq", "R1 == R2 as floating point numbers", feq),
+	compare("flt", "R1 < R2 as floating point numbers", flt),
+	compare("fle", "R1 <= R2 as floating point numbers", fle),
+	branch("jeq", "R0 == R1", eq),
+	branch("jne", "R0 != R1", ne),
+	branch("jlt", "R0 < R1 as signed integers", lt),
+	branch("jle", "R0 <= R1 as signed integers", le),
+	branch("jgt", "R0 > R1 as signed integers", swap(lt)),
+	branch("jge", "R0 >= R1 as signed integers", swap(le)),
+	branch("jltu", "R0 < R1 as unsigned integers", ltu),
+	branch("jleu", "R0 <= R1 as unsigned integers", leu),
+	branch("jgtu", "R0 > R1 as unsigned integers", swap(ltu)),
+	branch("jgeu", "R0 >= R1 as unsigned integers", swap(leu)),
+	branch("jfeq", "R0 == R1 as floating point numbers", feq),
+	branch("jflt", "R0 < R1 as floating point numbers", flt),
+	branch("jfle", "R0 <= R1 as floating point numbers", fle),
+	branch("jfgt", "R0 > R1 as floating point numbers", swap(flt)),
+	branch("jfge", "R0 >= R1 as floating point numbers", swap(fle)),
+	{
+		Name: "jmp",
+		Desc: "jump to page V0, position V1",
+		Func: func(v *vm.VM) error {
+			page := v.Pages[v.Page]
+			v.Page = vm.Get(&page[v.Pos+2]).GetU()
+			v.Pos = vm.Get(&page[v.Pos+10]).GetU()
+			return nil
+		},
+		Args:   []bool{false, false},
+		Labels: []bool{false, true},
+	},
+	{
+		Name: "jmpr",
+		Desc: "jump to page R0, position R1",
+		Func: func(v *vm.VM) error {
+			page := v.Pages[v.Page]
+			r0 := vm.Get(&page[v.Pos+2])
+			r1 := vm.Get(&page[v.Pos+10])
+			v.Page = v.Registers[r0].GetU()
+			v.Pos = v.Registers[r1].GetU()
+			return nil
+		},
+		Args: []bool{true, true},
+	},
+	{
+		Name: "br",
+		Desc: "jump V0 bytes from the start of this op, V0 can be negative",
+		Func: func(v *vm.VM) error {
+			v.Pos += vm.Get(&v.Pages[v.Page][v.Pos+2]).GetU()
+			return nil
+		},
+		Args:     []bool{false},
+		Relative: []bool{true},
+	},
+	{
+		Name: "brz",
+		Desc: "if R0 is 0, jump V0 bytes from the start of this op",
+		Func: func(v *vm.VM) error {
+			return relBranch(v, func(q vm.Qword) bool { return q == 0 })
+		},
+		Args:     []bool{true, false},
+		Relative: []bool{false, true},
+	},
+	{
+		Name: "brnz",
+		Desc: "if R0 is not 0, jump V0 bytes from the start of this op",
+		Func: func(v *vm.VM) error {
+			return relBranch(v, func(q vm.Qword) bool { return q != 0 })
+		},
+		Args:     []bool{true, false},
+		Relative: []bool{false, true},
+	},
+	{
+		Name: "call",
+		Desc: "push the position of the next op onto the call stack and jump to page R0, position R1",
+		Func: func(v *vm.VM) error {
+			page := v.Pages[v.Page]
+			r0 := vm.Get(&page[v.Pos+2])
+			r1 := vm.Get(&page[v.Pos+10])
+			return v.Call(v.Pos+2+8*2, v.Registers[r0].GetU(), v.Registers[r1].GetU())
+		},
+		Args: []bool{true, true},
+	},
+	{
+		Name: "callv",
+		Desc: "push the position of the next op onto the call stack and jump to page V0, position V1",
+		Func: func(v *vm.VM) error {
+			page := v.Pages[v.Page]
+			return v.Call(v.Pos+2+8*2, vm.Get(&page[v.Pos+2]).GetU(), vm.Get(&page[v.Pos+10]).GetU())
+		},
+		Args:   []bool{false, false},
+		Labels: []bool{false, true},
+	},
+	{
+		Name: "ret",
+		Desc: "pop the call stack and return to the position on it",
+		Func: func(v *vm.VM) error {
+			return v.Return()
+		},
+	},
 	// Keep this at the end
 	{
 		Name: "stop",
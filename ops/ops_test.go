@@ -211,6 +211,101 @@ func TestOps(t *testing.T) {
 			reg:      []vm.Qword{0, 0},
 			expected: []vm.Qword{0, 36},
 		},
+		{
+			name: "compare",
+			code: `
+        lt  2 0 1
+        ltu 3 0 1
+        eq  4 0 0
+        ne  5 0 0
+        le  6 1 0
+        stop
+      `,
+			reg:      []vm.Qword{vm.Qword(0xffffffffffffffff), 1, 9, 9, 9, 9, 9},
+			expected: []vm.Qword{vm.Qword(0xffffffffffffffff), 1, 1, 0, 1, 0, 0},
+		},
+		{
+			name: "fcompare",
+			code: `
+        flt 2 0 1
+        fle 3 1 0
+        feq 4 0 1
+        feq 5 6 6
+        stop
+      `,
+			reg:      []vm.Qword{vm.QwordF(-0.5), vm.QwordF(0.25), 9, 9, 9, 9, vm.CanonicalNaN},
+			expected: []vm.Qword{vm.QwordF(-0.5), vm.QwordF(0.25), 1, 0, 0, 0, vm.CanonicalNaN},
+		},
+		{
+			name: "branch",
+			code: `
+        jlt  1 0 0 bad // -1 is not less than -2
+        jgtu 0 1 0 bad // unsigned -2 is not more than -1
+        jgt  1 0 0 ok
+        bad:
+        set 100 0 // bad register, will error if we run this line
+        ok:
+        jfge 2 3 0 bad
+        jfgt 3 2 0 done
+        set 100 0
+        done:
+        stop
+      `,
+			reg:      []vm.Qword{vm.Qword(0xfffffffffffffffe), vm.Qword(0xffffffffffffffff), vm.QwordF(1.5), vm.QwordF(2)},
+			expected: []vm.Qword{vm.Qword(0xfffffffffffffffe), vm.Qword(0xffffffffffffffff), vm.QwordF(1.5), vm.QwordF(2)},
+		},
+		{
+			name: "jmp",
+			code: `
+        jmp 0 end
+        set 100 0 // bad register, will error if we run this line
+        end:
+        stop
+      `,
+		},
+		{
+			name: "jmpr",
+			code: `
+        set  1 end
+        jmpr 0 1
+        set  100 0 // bad register, will error if we run this line
+        end:
+        stop
+      `,
+			reg:      []vm.Qword{0, 0},
+			expected: []vm.Qword{0, 54},
+		},
+		{
+			name: "relative",
+			code: `
+        set  0 3
+        br   loop
+        back:
+        iaddv 1 1
+        isubv 0 1
+        loop:
+        brnz 0 back
+        brz  0 36
+        set  100 0 // bad register, will error if we run this line
+        stop
+      `,
+			reg:      []vm.Qword{0, 0},
+			expected: []vm.Qword{0, 3},
+		},
+		{
+			name: "call",
+			code: `
+        set   2 double
+        call  3 2
+        callv 0 double
+        stop
+        double:
+        iadd  0 0
+        ret
+      `,
+			reg:      []vm.Qword{3, 0, 0, 0},
+			expected: []vm.Qword{12, 0, 56, 0},
+		},
 	}
 
 	parser := List.Parser()
@@ -0,0 +1,57 @@
+package vm
+
+import (
+	"strconv"
+)
+
+// setPage handles "#page N" which moves to page N, anything that follows is
+// placed in that page. Page 0 is where execution starts.
+func (p *programmer) setPage(line lexedLine) error {
+	if len(line.word) != 2 {
+		return line.Error("Wrong number of arguments")
+	}
+	n, err := strconv.ParseUint(line.word[1], 10, 16)
+	if err != nil {
+		return line.Error("Bad page")
+	}
+	if p.object && n != 0 {
+		return line.Error("Objects must use #section")
+	}
+	p.toPage(int(n))
+	return nil
+}
+
+// section handles "#section name" which moves to the page with that name. The
+// first time a name is used it is given the next unused page and name is
+// defined as the page number.
+func (p *programmer) section(line lexedLine) error {
+	if len(line.word) != 2 {
+		return line.Error("Wrong number of arguments")
+	}
+	name := line.word[1]
+	if !isName(name) || name[0] == '.' {
+		return line.Error("Section must be a name")
+	}
+	page, ok := p.sections[name]
+	if !ok {
+		page = len(p.pages)
+		if err := p.define(name, Qword(page), line); err != nil {
+			return err
+		}
+		v := p.vars[name]
+		v.section = true
+		p.vars[name] = v
+		p.sections[name] = page
+	}
+	p.toPage(page)
+	return nil
+}
+
+func (p *programmer) toPage(n int) {
+	p.pages[p.page] = p.program
+	for len(p.pages) <= n {
+		p.pages = append(p.pages, nil)
+	}
+	p.page = n
+	p.program = p.pages[n]
+}
@@ -0,0 +1,195 @@
+package profile
+
+import (
+	"compress/gzip"
+	"fmt"
+	"github.com/dist-ribut-us/vm"
+	"io"
+	"sort"
+)
+
+// Field numbers from the pprof profile.proto
+const (
+	profileSampleType    = 1
+	profileSample        = 2
+	profileLocation      = 4
+	profileFunction      = 5
+	profileStringTable   = 6
+	profileTimeNanos     = 9
+	profileDurationNanos = 10
+	profilePeriodType    = 11
+	profilePeriod        = 12
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationID = 1
+	sampleValue      = 2
+	sampleLabel      = 3
+
+	labelKey = 1
+	labelStr = 2
+
+	locationID      = 1
+	locationAddress = 3
+	locationLine    = 4
+
+	lineFunctionID = 1
+	lineLine       = 2
+
+	functionID        = 1
+	functionName      = 2
+	functionFilename  = 4
+	functionStartLine = 5
+)
+
+// WritePprof writes the profile as a gzipped pprof protocol buffer. Every
+// location that ran is a sample with the count and time, labelled with the op
+// name. If info is not nil, locations are placed in functions named after the
+// closest global label before them with the source file and line, otherwise
+// each page is a function. The address of a location is page<<32 | pos.
+func (p *Profiler) WritePprof(w io.Writer, info *vm.DebugInfo) error {
+	var b pbuf
+	strs := map[string]int{"": 0}
+	strList := []string{""}
+	str := func(s string) uint64 {
+		i, ok := strs[s]
+		if !ok {
+			i = len(strList)
+			strs[s] = i
+			strList = append(strList, s)
+		}
+		return uint64(i)
+	}
+	valueType := func(typ, unit string) []byte {
+		var vt pbuf
+		vt.varint(valueTypeType, str(typ))
+		vt.varint(valueTypeUnit, str(unit))
+		return vt
+	}
+
+	b.message(profileSampleType, valueType("ops", "count"))
+	b.message(profileSampleType, valueType("time", "nanoseconds"))
+
+	ls := p.Locations()
+	sort.Slice(ls, func(i, j int) bool {
+		if ls[i].Page != ls[j].Page {
+			return ls[i].Page < ls[j].Page
+		}
+		return ls[i].Pos < ls[j].Pos
+	})
+
+	type fn struct {
+		id   uint64
+		name string
+		file string
+		line int
+	}
+	fns := make(map[string]*fn)
+	var fnList []*fn
+	for i, l := range ls {
+		var f fn
+		var line int
+		if li, ok := lineInfo(info, l); ok {
+			f.file, line = li.File, li.Line
+		}
+		if s, ok := function(info, l); ok {
+			f.name = s.Name
+			if li, ok := lineInfo(info, vm.Location{Page: l.Page, Pos: uint64(s.Value)}); ok {
+				f.line = li.Line
+			}
+		} else {
+			f.name = fmt.Sprintf("page%d", l.Page)
+		}
+		key := f.file + "\x00" + f.name
+		found, ok := fns[key]
+		if !ok {
+			f.id = uint64(len(fnList) + 1)
+			found = &f
+			fns[key] = found
+			fnList = append(fnList, found)
+		}
+
+		var ln pbuf
+		ln.varint(lineFunctionID, found.id)
+		ln.varint(lineLine, uint64(line))
+		var loc pbuf
+		loc.varint(locationID, uint64(i+1))
+		loc.varint(locationAddress, l.Page<<32|l.Pos)
+		loc.message(locationLine, ln)
+		b.message(profileLocation, loc)
+
+		s := p.Sites[l]
+		var lbl pbuf
+		lbl.varint(labelKey, str("op"))
+		lbl.varint(labelStr, str(p.opName(p.siteOps[l])))
+		var smp pbuf
+		smp.packed(sampleLocationID, []uint64{uint64(i + 1)})
+		smp.packed(sampleValue, []uint64{s.Count, uint64(s.Time)})
+		smp.message(sampleLabel, lbl)
+		b.message(profileSample, smp)
+	}
+
+	for _, f := range fnList {
+		var m pbuf
+		m.varint(functionID, f.id)
+		m.varint(functionName, str(f.name))
+		m.varint(functionFilename, str(f.file))
+		m.varint(functionStartLine, uint64(f.line))
+		b.message(profileFunction, m)
+	}
+
+	b.message(profilePeriodType, valueType("ops", "count"))
+	b.varint(profilePeriod, 1)
+	if !p.Start.IsZero() {
+		b.varint(profileTimeNanos, uint64(p.Start.UnixNano()))
+		b.varint(profileDurationNanos, uint64(p.Total().Time))
+	}
+	// the string table must be last so that every string has been added
+	for _, s := range strList {
+		b.message(profileStringTable, []byte(s))
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(b); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func lineInfo(info *vm.DebugInfo, l vm.Location) (vm.LineInfo, bool) {
+	if info == nil {
+		return vm.LineInfo{}, false
+	}
+	return info.Line(l.Page, l.Pos)
+}
+
+// pbuf encodes protocol buffer fields.
+type pbuf []byte
+
+func (b *pbuf) uvarint(u uint64) {
+	for u >= 0x80 {
+		*b = append(*b, byte(u)|0x80)
+		u >>= 7
+	}
+	*b = append(*b, byte(u))
+}
+
+func (b *pbuf) varint(field int, u uint64) {
+	b.uvarint(uint64(field) << 3)
+	b.uvarint(u)
+}
+
+func (b *pbuf) message(field int, m []byte) {
+	b.uvarint(uint64(field)<<3 | 2)
+	b.uvarint(uint64(len(m)))
+	*b = append(*b, m...)
+}
+
+func (b *pbuf) packed(field int, us []uint64) {
+	var m pbuf
+	for _, u := range us {
+		m.uvarint(u)
+	}
+	b.message(field, m)
+}
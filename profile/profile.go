@@ -0,0 +1,178 @@
+// Package profile counts how often and for how long each instruction of a VM
+// program runs and writes the results as text or in the pprof format so that
+// go tool pprof can be used on VM programs.
+package profile
+
+import (
+	"fmt"
+	"github.com/dist-ribut-us/vm"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Sample is the number of times an instruction or op ran and the time spent
+// running it.
+type Sample struct {
+	Count uint64
+	Time  time.Duration
+}
+
+// Profiler is a vm.Tracer that collects a Sample for every location that runs
+// and for every op. Names holds the name of each op that ran and Start is when
+// the first op ran.
+type Profiler struct {
+	Sites map[vm.Location]*Sample
+	Ops   map[vm.Op]*Sample
+	Names map[vm.Op]string
+	Start time.Time
+	start time.Time
+	// siteOps is the op that ran at each site
+	siteOps map[vm.Location]vm.Op
+}
+
+// New creates a Profiler, it is started by passing it to VM.Trace.
+func New() *Profiler {
+	return &Profiler{
+		Sites:   make(map[vm.Location]*Sample),
+		Ops:     make(map[vm.Op]*Sample),
+		Names:   make(map[vm.Op]string),
+		siteOps: make(map[vm.Location]vm.Op),
+	}
+}
+
+// Before fulfils vm.Tracer
+func (p *Profiler) Before(_ *vm.VM, _ *vm.TraceEvent) {
+	p.start = time.Now()
+	if p.Start.IsZero() {
+		p.Start = p.start
+	}
+}
+
+// After fulfils vm.Tracer
+func (p *Profiler) After(_ *vm.VM, e *vm.TraceEvent) {
+	d := time.Since(p.start)
+	site, ok := p.Sites[e.At]
+	if !ok {
+		site = &Sample{}
+		p.Sites[e.At] = site
+	}
+	p.siteOps[e.At] = e.Op
+	site.Count++
+	site.Time += d
+	op, ok := p.Ops[e.Op]
+	if !ok {
+		op = &Sample{}
+		p.Ops[e.Op] = op
+		p.Names[e.Op] = e.Name
+	}
+	op.Count++
+	op.Time += d
+}
+
+// Total returns the sum of all the samples.
+func (p *Profiler) Total() Sample {
+	var t Sample
+	for _, s := range p.Ops {
+		t.Count += s.Count
+		t.Time += s.Time
+	}
+	return t
+}
+
+// Locations returns the locations that ran, the most run first.
+func (p *Profiler) Locations() []vm.Location {
+	ls := make([]vm.Location, 0, len(p.Sites))
+	for l := range p.Sites {
+		ls = append(ls, l)
+	}
+	sort.Slice(ls, func(i, j int) bool {
+		si, sj := p.Sites[ls[i]], p.Sites[ls[j]]
+		if si.Count != sj.Count {
+			return si.Count > sj.Count
+		}
+		if ls[i].Page != ls[j].Page {
+			return ls[i].Page < ls[j].Page
+		}
+		return ls[i].Pos < ls[j].Pos
+	})
+	return ls
+}
+
+// opName returns the name of an op or its number if the name is not known.
+func (p *Profiler) opName(op vm.Op) string {
+	if name := p.Names[op]; name != "" {
+		return name
+	}
+	return fmt.Sprintf("op%d", op)
+}
+
+// WriteText writes a table of the ops then the n most run locations, or all of
+// them if n is 0. If info is not nil it is used to describe the locations.
+func (p *Profiler) WriteText(w io.Writer, info *vm.DebugInfo, n int) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	total := p.Total()
+	percent := func(s *Sample) string {
+		if total.Count == 0 {
+			return "0.0%"
+		}
+		return fmt.Sprintf("%.1f%%", 100*float64(s.Count)/float64(total.Count))
+	}
+
+	ops := make([]vm.Op, 0, len(p.Ops))
+	for op := range p.Ops {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		ci, cj := p.Ops[ops[i]].Count, p.Ops[ops[j]].Count
+		if ci != cj {
+			return ci > cj
+		}
+		return ops[i] < ops[j]
+	})
+	fmt.Fprintln(tw, "count\tpercent\ttime\top")
+	for _, op := range ops {
+		s := p.Ops[op]
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", s.Count, percent(s), s.Time, p.opName(op))
+	}
+
+	fmt.Fprintln(tw)
+	fmt.Fprintln(tw, "count\tpercent\ttime\tlocation")
+	ls := p.Locations()
+	if n > 0 && n < len(ls) {
+		ls = ls[:n]
+	}
+	for _, l := range ls {
+		s := p.Sites[l]
+		where := l.String()
+		if info != nil {
+			where = info.Describe(l.Page, l.Pos)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", s.Count, percent(s), s.Time, where)
+	}
+	return tw.Flush()
+}
+
+// function returns the name of the function that holds a location, which is
+// the closest global label before it. Local and macro labels are skipped.
+func function(info *vm.DebugInfo, l vm.Location) (vm.Symbol, bool) {
+	var best vm.Symbol
+	var found bool
+	if info == nil {
+		return best, false
+	}
+	for _, s := range info.Symbols {
+		if s.Kind != vm.SymbolLabel || uint64(s.Section) != l.Page || uint64(s.Value) > l.Pos {
+			continue
+		}
+		if strings.ContainsAny(s.Name, ".~") {
+			continue
+		}
+		if !found || s.Value > best.Value {
+			best, found = s, true
+		}
+	}
+	return best, found
+}
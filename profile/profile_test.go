@@ -0,0 +1,56 @@
+package profile
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/dist-ribut-us/vm"
+	"github.com/dist-ribut-us/vm/ops"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestProfiler(t *testing.T) {
+	a := ops.List.Assembler()
+	pages, info, err := a.AssembleDebug("mult.vm", `
+		set   0 7
+		set   1 4
+		loop:
+		iadd  2 0
+		isubv 1 1
+		jumpv 1 0 loop
+		stop
+	`)
+	assert.NoError(t, err)
+	v := vm.New(make([]vm.Qword, 3), pages[0], ops.List.Ops())
+	p := New()
+	v.Trace(ops.List, p)
+	assert.NoError(t, v.Run())
+
+	assert.Equal(t, uint64(15), p.Total().Count)
+	assert.Equal(t, uint64(4), p.Sites[vm.Location{Pos: 36}].Count)
+	assert.Equal(t, uint64(1), p.Sites[vm.Location{Pos: 0}].Count)
+	assert.Equal(t, uint64(2), p.Ops[1].Count)
+	assert.Equal(t, "set", p.Names[1])
+	assert.Equal(t, vm.Location{Pos: 36}, p.Locations()[0])
+
+	var text bytes.Buffer
+	assert.NoError(t, p.WriteText(&text, info, 2))
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	assert.Len(t, lines, 10)
+	assert.True(t, strings.HasPrefix(lines[0], "count"))
+	assert.Contains(t, lines[1], "iadd")
+	assert.Contains(t, lines[8], "loop (mult.vm:5)")
+	assert.Contains(t, lines[9], "loop+18 (mult.vm:6)")
+
+	var buf bytes.Buffer
+	assert.NoError(t, p.WritePprof(&buf, info))
+	gz, err := gzip.NewReader(&buf)
+	assert.NoError(t, err)
+	raw, err := io.ReadAll(gz)
+	assert.NoError(t, err)
+	for _, s := range []string{"ops", "nanoseconds", "loop", "mult.vm", "iadd"} {
+		assert.True(t, bytes.Contains(raw, []byte(s)), s)
+	}
+}
@@ -1,12 +1,21 @@
 package vm
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
 
+var (
+	errNoFS          = errors.New("assembler has no FS")
+	errMultiplePages = errors.New("program has multiple pages, use AssemblePages")
+	errNotNumber     = errors.New("not a number")
+)
+
 type opIdx struct {
 	Op
 	OpDef
@@ -15,173 +24,657 @@ type opIdx struct {
 // Parser returns a parsing function that will take a string and return a VM
 // program.
 func (os OpList) Parser() func(string) ([]byte, error) {
+	a := os.Assembler()
+	return func(program string) ([]byte, error) {
+		return a.Assemble("", program)
+	}
+}
+
+// Assembler turns source code into VM programs.
+type Assembler struct {
+	byName map[string]opIdx
+	// FS is used to resolve #include directives. Include paths are relative to
+	// the directory of the including file. If FS is nil, #include is an error.
+	FS fs.FS
+	// Defines are treated as if they were set with #def before the code,
+	// except that a #def of the same name in the code is ignored so Defines
+	// can override defaults set in the code. Names can not start with '.'.
+	Defines map[string]Qword
+}
+
+// Assembler returns an Assembler for the ops in the list.
+func (os OpList) Assembler() *Assembler {
 	byName := make(map[string]opIdx, len(os))
-	var idx Op
-	for _, op := range os {
-		if op.Idx != 0 {
-			idx = op.Idx
-		} else {
-			idx++
-		}
+	os.each(func(idx Op, op OpDef) {
 		byName[op.Name] = opIdx{
 			Op:    idx,
 			OpDef: op,
 		}
+	})
+	return &Assembler{
+		byName: byName,
+	}
+}
+
+// Assemble the code into a VM program. The name is used in errors and as the
+// base for relative includes, it can be left blank. If the code uses #page or
+// #section to produce more than one page, AssemblePages must be used.
+func (a *Assembler) Assemble(name, code string) ([]byte, error) {
+	pages, err := a.AssemblePages(name, code)
+	if err != nil {
+		return nil, err
 	}
+	if len(pages) > 1 {
+		return nil, errMultiplePages
+	}
+	return pages[0], nil
+}
 
-	return func(program string) ([]byte, error) {
-		p := programmer{
-			byName: byName,
-			code:   program,
-			vars:   make(map[string]variable),
-		}
-		if err := p.parse(); err != nil {
-			return nil, err
+// AssemblePages assembles the code into a VM program with one or more pages.
+// Execution starts on page 0.
+func (a *Assembler) AssemblePages(name, code string) ([][]byte, error) {
+	p := a.programmer()
+	if err := p.lex(name, code, nil); err != nil {
+		return nil, err
+	}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	if err := p.resolve(); err != nil {
+		return nil, err
+	}
+	return p.pages, nil
+}
+
+// AssembleFile reads the named file from FS and assembles it.
+func (a *Assembler) AssembleFile(name string) ([]byte, error) {
+	if a.FS == nil {
+		return nil, errNoFS
+	}
+	code, err := fs.ReadFile(a.FS, name)
+	if err != nil {
+		return nil, err
+	}
+	return a.Assemble(name, string(code))
+}
+
+func (a *Assembler) programmer() *programmer {
+	vars := make(map[string]variable, len(a.Defines))
+	for name, val := range a.Defines {
+		vars[name] = variable{
+			value:    val,
+			defined:  true,
+			override: true,
 		}
-		return p.program, nil
+	}
+	return &programmer{
+		byName:   a.byName,
+		fs:       a.FS,
+		vars:     vars,
+		regs:     make(map[string]Qword),
+		macros:   make(map[string]macro),
+		pages:    [][]byte{nil},
+		sections: make(map[string]int),
+		aligns:   make(map[int]int),
+		exports:  make(map[string]lexedLine),
 	}
 }
 
 type programmer struct {
-	byName  map[string]opIdx
-	code    string
-	program []byte
-	vars    map[string]variable
-	lexed   []lexedLine
+	byName map[string]opIdx
+	fs     fs.FS
+	// program is the page currently being written, it is stored in pages when
+	// the page changes and at the end of parsing.
+	program  []byte
+	page     int
+	pages    [][]byte
+	sections map[string]int
+	vars     map[string]variable
+	regs     map[string]Qword
+	lexed    []lexedLine
+	macros   map[string]macro
+	expands  int
+	// scope is the last global label, local labels starting with a '.' belong
+	// to it.
+	scope string
+	// object is set when producing an Object, exports are the names marked
+	// with #export
+	object  bool
+	exports map[string]lexedLine
+	// lines records where each line that produced bytes was placed, listed
+	// records where every line was placed.
+	lines  []LineInfo
+	listed []listedLine
+	// aligns is a multiple of every #align used in each page
+	aligns map[int]int
 }
 
 type variable struct {
-	instance []int
+	instance []fixup
 	value    Qword
+	defined  bool
+	// label is true if the variable is a label, page is the page it is on.
+	label bool
+	page  Qword
+	// section is true if the variable is the name of a section
+	section bool
+	// override is true if the variable is from Assembler.Defines and has
+	// not yet been defined in the code
+	override bool
+}
+
+// fixup is a place in the program where the value of a variable is written
+// once all variables are known. If isPage is true, the page of a label is
+// written instead of its value. If rel is true, the distance from the op at
+// op to the label is written. If reg is true, the fixup is a register arg and
+// the variable must be a definition.
+type fixup struct {
+	page   int
+	pos    int
+	isPage bool
+	rel    bool
+	reg    bool
+	op     int
+	line   lexedLine
 }
 
 var labelRe = regexp.MustCompile(`\w+:`)
 
 func (p *programmer) parse() error {
-	p.lex()
+	for _, name := range p.varNames() {
+		if p.vars[name].override && (!isName(name) || name[0] == '.') {
+			return fmt.Errorf("define %q is not a name", name)
+		}
+	}
+	if err := p.expand(); err != nil {
+		return err
+	}
 	for _, line := range p.lexed {
-		opName := line.word[0]
-		if opName == "#def" {
-			if err := p.def(line); err != nil {
-				return err
-			}
-			continue
+		page, start := p.page, len(p.program)
+		if err := p.parseLine(line); err != nil {
+			return err
 		}
-		if labelRe.MatchString(opName) {
-			opName = string(opName[:len(opName)-1])
-			v := p.vars[opName]
-			v.value = Qword(len(p.program))
-			p.vars[opName] = v
-			continue
+		listed := listedLine{
+			line:  line,
+			page:  p.page,
+			start: len(p.program),
+			end:   len(p.program),
 		}
-		op, ok := p.byName[opName]
-		if !ok {
-			return line.Error("Op not found")
+		if p.page == page {
+			listed.start = start
 		}
-		if err := p.appendOp(op, line); err != nil {
-			return err
+		p.listed = append(p.listed, listed)
+		if p.page == page && len(p.program) > start {
+			p.lines = append(p.lines, LineInfo{
+				Page: uint64(page),
+				Pos:  uint64(start),
+				File: line.file,
+				Line: line.number,
+				Op:   line.word[0][0] != '#',
+			})
+		}
+	}
+	p.pages[p.page] = p.program
+	exports := make([]string, 0, len(p.exports))
+	for name := range p.exports {
+		exports = append(exports, name)
+	}
+	sort.Strings(exports)
+	for _, name := range exports {
+		if !p.vars[name].defined {
+			return p.exports[name].Error("Export not defined")
 		}
 	}
-	for _, v := range p.vars {
-		for _, i := range v.instance {
-			v.value.Put(&(p.program[i]))
+	return nil
+}
+
+func (p *programmer) parseLine(line lexedLine) error {
+	opName := line.word[0]
+	if opName[0] == '#' {
+		return p.directive(line)
+	}
+	if labelRe.MatchString(opName) {
+		opName = string(opName[:len(opName)-1])
+		if !isName(opName) {
+			return line.Error("Label must be a name")
+		}
+		if opName[0] != '.' && !strings.Contains(opName, "~") {
+			p.scope = opName
+		}
+		return p.defineLabel(p.scoped(opName), line)
+	}
+	op, ok := p.byName[opName]
+	if !ok {
+		return line.Error("Op not found")
+	}
+	return p.appendOp(op, line)
+}
+
+// varNames returns the names of all the variables in order, so that errors
+// are the same each time.
+func (p *programmer) varNames() []string {
+	names := make([]string, 0, len(p.vars))
+	for n := range p.vars {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// resolve writes the value of every variable into the places it is used.
+func (p *programmer) resolve() error {
+	for _, name := range p.varNames() {
+		v := p.vars[name]
+		for _, f := range v.instance {
+			if !v.defined {
+				return f.line.Error("Not defined")
+			}
+			if f.reg && (v.label || v.section) {
+				return f.line.Error("Label used as register")
+			}
+			val := v.value
+			if f.isPage {
+				if !v.label {
+					return f.line.Error("Page of value that is not a label")
+				}
+				val = v.page
+			}
+			if f.rel {
+				var err error
+				if val, err = f.relative(v); err != nil {
+					return err
+				}
+			}
+			val.Put(&(p.pages[f.page][f.pos]))
 		}
 	}
 	return nil
 }
 
+// define sets the value of a label or definition, each can only be defined
+// once.
+func (p *programmer) define(name string, value Qword, line lexedLine) error {
+	if _, isReg := p.regs[name]; isReg {
+		return line.Error("Name is a register alias")
+	}
+	v := p.vars[name]
+	if v.defined {
+		return line.Error("Already defined")
+	}
+	v.value = value
+	v.defined = true
+	p.vars[name] = v
+	return nil
+}
+
+// defineLabel sets name to the current position.
+func (p *programmer) defineLabel(name string, line lexedLine) error {
+	if err := p.define(name, Qword(len(p.program)), line); err != nil {
+		return err
+	}
+	v := p.vars[name]
+	v.label = true
+	v.page = Qword(p.page)
+	p.vars[name] = v
+	return nil
+}
+
+// scoped returns the full name of a local label, which starts with a '.' and
+// belongs to the preceding global label. Other names are returned unchanged.
+func (p *programmer) scoped(name string) string {
+	if strings.HasPrefix(name, ".") {
+		return p.scope + name
+	}
+	return name
+}
+
 func (p *programmer) appendOp(op opIdx, line lexedLine) error {
 	if len(line.word)-1 != len(op.Args) {
 		return line.Error("Wrong number of arguments")
 	}
-	pos := len(p.program) + 2
+	start := len(p.program)
+	pos := start + 2
 	p.program = append(p.program, op.Bytes(len(op.Args))...)
 	for i, arg := range line.word[1:] {
-		p.setArg(arg, pos+i*8)
+		var err error
+		if i < len(op.Relative) && op.Relative[i] {
+			err = p.setRelArg(arg, pos+i*8, start, line)
+		} else {
+			err = p.setArg(arg, op.Args[i], pos+i*8, line)
+		}
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+func (p *programmer) directive(line lexedLine) error {
+	switch line.word[0] {
+	case "#def":
+		return p.def(line)
+	case "#reg":
+		return p.reg(line)
+	case "#unreg":
+		return p.unreg(line)
+	case "#qword":
+		return p.qword(line)
+	case "#float":
+		return p.float(line)
+	case "#bytes":
+		return p.bytes(line)
+	case "#string":
+		return p.string(line)
+	case "#align":
+		return p.align(line)
+	case "#zero":
+		return p.zero(line)
+	case "#page":
+		return p.setPage(line)
+	case "#section":
+		return p.section(line)
+	case "#export":
+		return p.export(line)
+	}
+	return line.Error("Unknown directive")
+}
+
 func (p *programmer) def(line lexedLine) error {
 	if len(line.word) != 3 {
 		return line.Error("Wrong number of arguments")
 	}
 	name := line.word[1]
+	if !isName(name) {
+		return line.Error("Definition must be a name")
+	}
 	val, isWord, err := convertArg(line.word[2])
 	if err != nil {
-		return err
+		return line.Error("Bad number")
 	}
 	if isWord {
 		return line.Error("definition must be a number")
 	}
-	v := p.vars[name]
-	v.value = val
-	p.vars[name] = v
+	name = p.scoped(name)
+	if v := p.vars[name]; v.override {
+		// the value from Assembler.Defines is kept
+		v.override = false
+		p.vars[name] = v
+		return nil
+	}
+	return p.define(name, val, line)
+}
+
+// reg handles "#reg name N" which makes name an alias for register N until it
+// is removed with "#unreg name". Aliases can only be used as register args and
+// while a register has an alias its number can not be used.
+func (p *programmer) reg(line lexedLine) error {
+	if len(line.word) != 3 {
+		return line.Error("Wrong number of arguments")
+	}
+	name := line.word[1]
+	if !isName(name) || name[0] == '.' {
+		return line.Error("Register alias must be a name")
+	}
+	if _, isVar := p.vars[name]; isVar {
+		return line.Error("Register alias is already defined")
+	}
+	if _, isReg := p.regs[name]; isReg {
+		return line.Error("Register alias is already defined")
+	}
+	r, err := strconv.ParseUint(line.word[2], 10, 64)
+	if err != nil {
+		return line.Error("Register must be an integer")
+	}
+	p.regs[name] = Qword(r)
+	return nil
+}
+
+// hasAlias returns true if register r has a register alias.
+func (p *programmer) hasAlias(r Qword) bool {
+	for _, a := range p.regs {
+		if a == r {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *programmer) unreg(line lexedLine) error {
+	if len(line.word) != 2 {
+		return line.Error("Wrong number of arguments")
+	}
+	if _, isReg := p.regs[line.word[1]]; !isReg {
+		return line.Error("Register alias not defined")
+	}
+	delete(p.regs, line.word[1])
 	return nil
 }
 
 type lexedLine struct {
+	file   string
 	number int
 	word   []string
 	raw    string
+	// call is the line that invoked the macro this line was expanded from
+	call *lexedLine
 }
 
 func (l lexedLine) Error(ErrorType string) LineError {
-	return LineError{
-		LineNumber: l.number,
+	le := LineError{
+		File:       l.file,
+		LineNumber: l.number - 1,
 		LineString: l.raw,
 		ErrorType:  ErrorType,
 	}
+	if l.call != nil {
+		call := l.call.Error("")
+		le.Call = &call
+	}
+	return le
 }
 
-// LineError represents an error in a specific line
+// LineError represents an error in a specific line. File is the name of the
+// file the line came from, it is blank for code passed in directly. LineNumber
+// counts from 0, Position and Error count from 1. If the line came from a
+// macro, Call is the line that invoked the macro.
 type LineError struct {
+	File       string
 	LineNumber int
 	LineString string
 	ErrorType  string
+	Call       *LineError
 }
 
 // Error fulfils the error interface and indicates where the error occured
 func (le LineError) Error() string {
-	return fmt.Sprintf("%s) %d: %s", le.ErrorType, le.LineNumber, le.LineString)
+	s := fmt.Sprintf("%s) %s: %s", le.ErrorType, le.Position(), le.LineString)
+	for c := le.Call; c != nil; c = c.Call {
+		s += fmt.Sprintf("\n\tfrom macro call %s: %s", c.Position(), c.LineString)
+	}
+	return s
 }
 
-var lineRe = regexp.MustCompile(`^[ \t]*#?(?:([\w\.]+:?)[ \t]*)+`)
-var partsRe = regexp.MustCompile(`#?[\w\.]+:?`)
+// Position returns the line number counting from 1, prefixed by the file name
+// if there is one.
+func (le LineError) Position() string {
+	return position(le.File, le.LineNumber+1)
+}
 
-func (p *programmer) lex() {
-	for li, lineStr := range strings.Split(p.code, "\n") {
+func position(file string, line int) string {
+	if file == "" {
+		return strconv.Itoa(line)
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+var tokenRe = regexp.MustCompile(`^[ \t]*([#@]?-?[\w\.]+:?|"(?:[^"\\]|\\.)*")`)
+
+// lex splits the code into lines of words. Words are names, numbers or quoted
+// strings, anything else ends the line so it can be used for comments.
+// Directive names are lower cased. Any #include is replaced by the lines of the
+// included file, stack holds the files currently being included.
+func (p *programmer) lex(file, code string, stack []string) error {
+	for li, lineStr := range strings.Split(code, "\n") {
 		raw := strings.TrimSpace(lineStr)
-		lineStr = lineRe.FindString(raw)
-		words := partsRe.FindAllString(lineStr, -1)
+		words, _ := lexWords(raw)
 		if len(words) == 0 {
 			continue
 		}
-		p.lexed = append(p.lexed, lexedLine{
-			number: li,
+		if words[0][0] == '#' {
+			// directives are not case sensitive
+			words[0] = strings.ToLower(words[0])
+		}
+		line := lexedLine{
+			file:   file,
+			number: li + 1,
 			word:   words,
 			raw:    raw,
-		})
+		}
+		if words[0] == "#include" {
+			if err := p.include(line, append(stack, file)); err != nil {
+				return err
+			}
+			continue
+		}
+		p.lexed = append(p.lexed, line)
 	}
+	return nil
 }
 
-func (p *programmer) setArg(arg string, pos int) error {
+// lexWords returns the words in the line and the rest of the line after the
+// last word, which is treated as a comment.
+func lexWords(line string) ([]string, string) {
+	var words []string
+	for {
+		m := tokenRe.FindStringSubmatch(line)
+		if m == nil {
+			return words, strings.TrimSpace(line)
+		}
+		words = append(words, m[1])
+		line = line[len(m[0]):]
+	}
+}
+
+// setArg writes the arg at pos. Register args can be a number, a register
+// alias or a definition, value args can be a number, a definition, a label or
+// the page of a label written as @label. A register that has an alias must be
+// used by its alias.
+func (p *programmer) setArg(arg string, isReg bool, pos int, line lexedLine) error {
+	isPage := strings.HasPrefix(arg, "@")
+	if isPage {
+		if isReg {
+			return line.Error("Page used as register")
+		}
+		arg = arg[1:]
+		if !isName(arg) {
+			return line.Error("Page must be of a label")
+		}
+	}
 	r, isArg, err := convertArg(arg)
 	if err != nil {
-		return err
+		return line.Error("Bad number")
 	}
 	if !isArg {
+		if isReg && p.hasAlias(r) {
+			return line.Error("Register has an alias")
+		}
 		r.Put(&(p.program[pos]))
 		return nil
 	}
 
-	v := p.vars[arg]
-	v.instance = append(v.instance, pos)
-	p.vars[arg] = v
+	if r, ok := p.regs[arg]; ok {
+		if !isReg {
+			return line.Error("Register alias used as value")
+		}
+		r.Put(&(p.program[pos]))
+		return nil
+	}
+
+	name := p.scoped(arg)
+	v := p.vars[name]
+	v.instance = append(v.instance, fixup{
+		page:   p.page,
+		pos:    pos,
+		isPage: isPage,
+		reg:    isReg,
+		line:   line,
+	})
+	p.vars[name] = v
 	return nil
 }
 
+// setRelArg writes an arg that is relative to the op starting at op. A number
+// is written as it is, a label is written as the distance from the op.
+func (p *programmer) setRelArg(arg string, pos, op int, line lexedLine) error {
+	r, isArg, err := convertArg(arg)
+	if err != nil {
+		return line.Error("Bad number")
+	}
+	if !isArg {
+		r.Put(&(p.program[pos]))
+		return nil
+	}
+	if _, ok := p.regs[arg]; ok || strings.HasPrefix(arg, "@") {
+		return line.Error("Relative arg must be a label or number")
+	}
+	name := p.scoped(arg)
+	v := p.vars[name]
+	v.instance = append(v.instance, fixup{
+		page: p.page,
+		pos:  pos,
+		rel:  true,
+		op:   op,
+		line: line,
+	})
+	p.vars[name] = v
+	return nil
+}
+
+// relative returns the distance from the op to the label v.
+func (f fixup) relative(v variable) (Qword, error) {
+	if !v.label {
+		return 0, f.line.Error("Relative arg must be a label or number")
+	}
+	if int(v.page) != f.page {
+		return 0, f.line.Error("Relative label in another page")
+	}
+	return v.value - Qword(f.op), nil
+}
+
+// isName returns true if s starts with a letter or underscore, optionally
+// preceded by a '.' for local labels.
+func isName(s string) bool {
+	s = strings.TrimPrefix(s, ".")
+	if s == "" {
+		return false
+	}
+	c := s[0]
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// ParseValue parses a number the same way as a value arg. Numbers containing a
+// '.' are floats.
+func ParseValue(s string) (Qword, error) {
+	q, isName, err := convertArg(s)
+	if err == nil && isName {
+		err = errNotNumber
+	}
+	return q, err
+}
+
 func convertArg(arg string) (Qword, bool, error) {
+	if isName(arg) {
+		return 0, true, nil
+	}
+
+	if strings.HasPrefix(arg, "-") && !strings.Contains(arg, ".") {
+		i, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return 0, false, err
+		}
+		return Qword(i), false, nil
+	}
+
 	if strings.Contains(arg, ".") {
 		f, err := strconv.ParseFloat(arg, 64)
 		if err != nil {
@@ -192,9 +685,8 @@ func convertArg(arg string) (Qword, bool, error) {
 	}
 
 	u, err := strconv.ParseUint(arg, 10, 64)
-	if err == nil {
-		return Qword(u), false, nil
+	if err != nil {
+		return 0, false, err
 	}
-
-	return 0, true, nil
+	return Qword(u), false, nil
 }
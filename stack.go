@@ -0,0 +1,43 @@
+package vm
+
+import (
+	"errors"
+)
+
+// Errors returned by Call and Return
+var (
+	ErrStackOverflow = errors.New("call stack overflow")
+	ErrEmptyStack    = errors.New("return with an empty call stack")
+)
+
+// DefaultMaxDepth is the depth of the call stack used if MaxDepth is 0.
+const DefaultMaxDepth = 1024
+
+// Call pushes page and ret onto the call stack, where ret is the position to
+// return to in the current page, then moves to page, pos. It returns
+// ErrStackOverflow if the stack is already at MaxDepth and leaves the VM
+// unchanged.
+func (vm *VM) Call(ret, page, pos uint64) error {
+	max := vm.MaxDepth
+	if max == 0 {
+		max = DefaultMaxDepth
+	}
+	if len(vm.Stack) >= max {
+		return ErrStackOverflow
+	}
+	vm.Stack = append(vm.Stack, Location{Page: vm.Page, Pos: ret})
+	vm.Page, vm.Pos = page, pos
+	return nil
+}
+
+// Return pops the call stack and moves to the location that was pushed. It
+// returns ErrEmptyStack if there is nothing to return to.
+func (vm *VM) Return() error {
+	if len(vm.Stack) == 0 {
+		return ErrEmptyStack
+	}
+	l := vm.Stack[len(vm.Stack)-1]
+	vm.Stack = vm.Stack[:len(vm.Stack)-1]
+	vm.Page, vm.Pos = l.Page, l.Pos
+	return nil
+}
@@ -0,0 +1,347 @@
+package vm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Tracer is called around every op the VM runs once it is set with Trace.
+// Before is called before the op runs and After once it has finished, when
+// Deltas and Err have been filled in. The same TraceEvent is passed to both.
+type Tracer interface {
+	Before(*VM, *TraceEvent)
+	After(*VM, *TraceEvent)
+}
+
+// TraceEvent describes an op run by the VM. Count is the value of VM.Count for
+// the op, so the first op is 1. Name and Args are decoded with the OpList
+// passed to Trace, Name is empty if the op is not in the list. Deltas holds the
+// registers the op changed in order, Writes the memory it changed with Write
+// or Touch and Err the error it returned, including a panic that Run would turn
+// into an error.
+type TraceEvent struct {
+	Count  uint64
+	At     Location
+	Op     Op
+	Name   string
+	Args   []Qword
+	Deltas []RegisterDelta
+	Writes []MemoryWrite
+	Err    error
+}
+
+// RegisterDelta is a change to a register made by an op.
+type RegisterDelta struct {
+	Register uint64 `json:"reg"`
+	Old      Qword  `json:"old"`
+	New      Qword  `json:"new"`
+}
+
+// MemoryWrite is a change to memory made by an op.
+type MemoryWrite struct {
+	At       Location
+	Old, New []byte
+}
+
+type tracer struct {
+	tracers []Tracer
+	decode  func([]byte, uint64) (Instruction, bool)
+	regs    []Qword
+	// event is set while an op is running
+	event *TraceEvent
+}
+
+// Trace sets the tracers that are called for every op, ops is used to decode
+// the args. Calling Trace with no tracers turns tracing off.
+func (vm *VM) Trace(ops OpList, ts ...Tracer) {
+	if len(ts) == 0 {
+		vm.trace = nil
+		return
+	}
+	vm.trace = &tracer{
+		tracers: ts,
+		decode:  ops.Decoder(),
+	}
+}
+
+// step runs the op at the current position with the tracers around it.
+func (t *tracer) step(vm *VM, op Op) error {
+	e := &TraceEvent{
+		Count: vm.Count,
+		At:    Location{Page: vm.Page, Pos: vm.Pos},
+		Op:    op,
+	}
+	if in, ok := t.decode(vm.Pages[vm.Page], vm.Pos); ok {
+		e.Name = in.Def.Name
+		e.Args = in.Args
+	}
+	t.regs = append(t.regs[:0], vm.Registers...)
+	for _, tr := range t.tracers {
+		tr.Before(vm, e)
+	}
+
+	t.event = e
+	e.Err = func() (err error) {
+		if !vm.Panic {
+			defer vm.recover(&err)
+		}
+		return vm.Ops[op](vm)
+	}()
+	t.event = nil
+	for i, w := range e.Writes {
+		e.Writes[i].New, _ = vm.bytes(w.At.Page, w.At.Pos, uint64(len(w.Old)))
+	}
+
+	n := len(vm.Registers)
+	if len(t.regs) > n {
+		n = len(t.regs)
+	}
+	for r := 0; r < n; r++ {
+		var old Qword
+		if r < len(t.regs) {
+			old = t.regs[r]
+		}
+		if q := vm.register(uint64(r)); q != old {
+			e.Deltas = append(e.Deltas, RegisterDelta{
+				Register: uint64(r),
+				Old:      old,
+				New:      q,
+			})
+		}
+	}
+	for _, tr := range t.tracers {
+		tr.After(vm, e)
+	}
+	return e.Err
+}
+
+const (
+	traceMagic   = "vmtrc1"
+	maxTraceData = 1 << 20
+)
+
+// ErrNotTrace is returned by ReadTrace if the data is not a binary trace
+var ErrNotTrace = errors.New("not a VM trace")
+
+// TraceWriter is a Tracer that writes every op to a writer, either as a line
+// of JSON or in a compact binary form that can be read with ReadTrace. The
+// first write error stops the trace and is returned by Err.
+type TraceWriter struct {
+	w      io.Writer
+	binary bool
+	magic  bool
+	err    error
+}
+
+// JSONTracer returns a TraceWriter that writes a line of JSON for every op.
+func JSONTracer(w io.Writer) *TraceWriter {
+	return &TraceWriter{w: w}
+}
+
+// BinaryTracer returns a TraceWriter that writes the binary trace format.
+func BinaryTracer(w io.Writer) *TraceWriter {
+	return &TraceWriter{w: w, binary: true}
+}
+
+// Err returns the first error writing the trace.
+func (tw *TraceWriter) Err() error {
+	return tw.err
+}
+
+// Before fulfils Tracer, nothing is written until the op has run.
+func (tw *TraceWriter) Before(*VM, *TraceEvent) {}
+
+// After fulfils Tracer and writes the event.
+func (tw *TraceWriter) After(_ *VM, e *TraceEvent) {
+	if tw.err != nil {
+		return
+	}
+	var buf []byte
+	if tw.binary {
+		if !tw.magic {
+			buf = []byte(traceMagic)
+			tw.magic = true
+		}
+		buf = appendTraceEvent(buf, e)
+	} else {
+		buf, tw.err = json.Marshal(traceLine(e))
+		buf = append(buf, '\n')
+	}
+	if tw.err == nil {
+		_, tw.err = tw.w.Write(buf)
+	}
+}
+
+type jsonTraceEvent struct {
+	Count  uint64            `json:"count"`
+	Page   uint64            `json:"page"`
+	Pos    uint64            `json:"pos"`
+	Op     Op                `json:"op"`
+	Name   string            `json:"name,omitempty"`
+	Args   []Qword           `json:"args,omitempty"`
+	Deltas []RegisterDelta   `json:"deltas,omitempty"`
+	Writes []jsonMemoryWrite `json:"writes,omitempty"`
+	Err    string            `json:"err,omitempty"`
+}
+
+type jsonMemoryWrite struct {
+	Page uint64 `json:"page"`
+	Pos  uint64 `json:"pos"`
+	Old  string `json:"old"`
+	New  string `json:"new"`
+}
+
+func traceLine(e *TraceEvent) jsonTraceEvent {
+	l := jsonTraceEvent{
+		Count:  e.Count,
+		Page:   e.At.Page,
+		Pos:    e.At.Pos,
+		Op:     e.Op,
+		Name:   e.Name,
+		Args:   e.Args,
+		Deltas: e.Deltas,
+	}
+	for _, w := range e.Writes {
+		l.Writes = append(l.Writes, jsonMemoryWrite{
+			Page: w.At.Page,
+			Pos:  w.At.Pos,
+			Old:  hex.EncodeToString(w.Old),
+			New:  hex.EncodeToString(w.New),
+		})
+	}
+	if e.Err != nil {
+		l.Err = e.Err.Error()
+	}
+	return l
+}
+
+// appendTraceEvent writes an event as uvarints for the count, page, pos and
+// op, then the args, deltas and writes each preceded by how many there are and
+// finally the error string preceded by its length. Register numbers are
+// uvarints and values are 8 bytes. A write is its page and pos then the old and
+// new bytes each preceded by their length.
+func appendTraceEvent(buf []byte, e *TraceEvent) []byte {
+	buf = binary.AppendUvarint(buf, e.Count)
+	buf = binary.AppendUvarint(buf, e.At.Page)
+	buf = binary.AppendUvarint(buf, e.At.Pos)
+	buf = binary.AppendUvarint(buf, uint64(e.Op))
+	buf = binary.AppendUvarint(buf, uint64(len(e.Args)))
+	for _, a := range e.Args {
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(a))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(e.Deltas)))
+	for _, d := range e.Deltas {
+		buf = binary.AppendUvarint(buf, d.Register)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(d.Old))
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(d.New))
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(e.Writes)))
+	for _, w := range e.Writes {
+		buf = binary.AppendUvarint(buf, w.At.Page)
+		buf = binary.AppendUvarint(buf, w.At.Pos)
+		buf = binary.AppendUvarint(buf, uint64(len(w.Old)))
+		buf = append(buf, w.Old...)
+		buf = binary.AppendUvarint(buf, uint64(len(w.New)))
+		buf = append(buf, w.New...)
+	}
+	var msg string
+	if e.Err != nil {
+		msg = e.Err.Error()
+	}
+	buf = binary.AppendUvarint(buf, uint64(len(msg)))
+	return append(buf, msg...)
+}
+
+// ReadTrace reads a trace written by a BinaryTracer. Names are not part of the
+// binary format so they are left empty.
+func ReadTrace(r io.Reader) ([]TraceEvent, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(traceMagic))
+	if _, err := io.ReadFull(br, magic); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, ErrNotTrace
+	}
+	if string(magic) != traceMagic {
+		return nil, ErrNotTrace
+	}
+	var es []TraceEvent
+	for {
+		e, err := readTraceEvent(br)
+		if err == io.EOF {
+			return es, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		es = append(es, e)
+	}
+}
+
+func readTraceEvent(br *bufio.Reader) (TraceEvent, error) {
+	var e TraceEvent
+	var err error
+	uvarint := func() uint64 {
+		var u uint64
+		if err == nil {
+			u, err = binary.ReadUvarint(br)
+		}
+		return u
+	}
+	qword := func() Qword {
+		var b [8]byte
+		if err == nil {
+			_, err = io.ReadFull(br, b[:])
+		}
+		return Qword(binary.LittleEndian.Uint64(b[:]))
+	}
+
+	e.Count = uvarint()
+	if err != nil {
+		return e, err
+	}
+	e.At.Page = uvarint()
+	e.At.Pos = uvarint()
+	e.Op = Op(uvarint())
+	for n := uvarint(); n > 0 && err == nil; n-- {
+		e.Args = append(e.Args, qword())
+	}
+	for n := uvarint(); n > 0 && err == nil; n-- {
+		e.Deltas = append(e.Deltas, RegisterDelta{
+			Register: uvarint(),
+			Old:      qword(),
+			New:      qword(),
+		})
+	}
+	data := func() []byte {
+		n := uvarint()
+		if n > maxTraceData && err == nil {
+			err = ErrNotTrace
+		}
+		if n == 0 || err != nil {
+			return nil
+		}
+		b := make([]byte, n)
+		_, err = io.ReadFull(br, b)
+		return b
+	}
+	for n := uvarint(); n > 0 && err == nil; n-- {
+		e.Writes = append(e.Writes, MemoryWrite{
+			At:  Location{Page: uvarint(), Pos: uvarint()},
+			Old: data(),
+			New: data(),
+		})
+	}
+	if msg := data(); len(msg) > 0 && err == nil {
+		e.Err = errors.New(string(msg))
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return e, err
+}
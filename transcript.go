@@ -0,0 +1,78 @@
+package vm
+
+import (
+	"crypto/sha256"
+	"hash"
+)
+
+// Transcript is a Tracer that keeps a running SHA-256 hash of every op that
+// runs and the changes it makes, so two VMs that ran the same program can
+// compare a single digest. Each op adds the same bytes as the binary trace
+// format, op names are not part of it so the digest does not depend on them.
+//
+// If Interval is not 0, the digest is saved in Checkpoints every Interval ops
+// so Diverged can find roughly where two runs went different ways.
+type Transcript struct {
+	Interval    uint64
+	Checkpoints []Checkpoint
+	h           hash.Hash
+	buf         []byte
+}
+
+// Checkpoint is the digest of a Transcript after Count ops.
+type Checkpoint struct {
+	Count uint64
+	Sum   [sha256.Size]byte
+}
+
+// NewTranscript creates a Transcript, it is started by passing it to
+// VM.Trace.
+func NewTranscript() *Transcript {
+	return &Transcript{
+		h: sha256.New(),
+	}
+}
+
+// Before fulfils Tracer
+func (t *Transcript) Before(*VM, *TraceEvent) {}
+
+// After fulfils Tracer and adds the event to the hash.
+func (t *Transcript) After(_ *VM, e *TraceEvent) {
+	t.buf = appendTraceEvent(t.buf[:0], e)
+	t.h.Write(t.buf)
+	if t.Interval != 0 && e.Count%t.Interval == 0 {
+		t.Checkpoints = append(t.Checkpoints, Checkpoint{
+			Count: e.Count,
+			Sum:   t.Sum(),
+		})
+	}
+}
+
+// Sum returns the digest of everything run so far.
+func (t *Transcript) Sum() [sha256.Size]byte {
+	var sum [sha256.Size]byte
+	t.h.Sum(sum[:0])
+	return sum
+}
+
+// Diverged compares the checkpoints from two runs. It returns the Count of the
+// first checkpoint that is different and true, or false if they all match.
+// The runs went different ways after the previous checkpoint.
+func Diverged(a, b []Checkpoint) (uint64, bool) {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return a[i].Count, true
+		}
+	}
+	switch {
+	case len(a) > n:
+		return a[n].Count, true
+	case len(b) > n:
+		return b[n].Count, true
+	}
+	return 0, false
+}
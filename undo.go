@@ -0,0 +1,210 @@
+package vm
+
+import (
+	"errors"
+)
+
+// ErrNoHistory is returned by Back if there are not enough recorded steps to
+// go back.
+var ErrNoHistory = errors.New("not enough recorded history")
+
+// undoLog is a ring buffer holding an undo entry for each of the most recent
+// steps.
+type undoLog struct {
+	entries []undoEntry
+	// next is the index the next entry is written to and n is how many
+	// entries are held.
+	next, n int
+	regs    []Qword
+	// active is true while an op is running
+	active bool
+}
+
+// undoEntry holds what is needed to put the VM back to how it was before a
+// step. Registers holds the old value of each register that changed and
+// memory the old bytes of each change in the order they were made.
+type undoEntry struct {
+	page, pos uint64
+	count     uint64
+	stop      bool
+	pages     int
+	registers []RegisterDelta
+	memory    []memUndo
+	// stack is the depth of the call stack and top the location on top of
+	// it, an op can only push or pop one location.
+	stack int
+	top   Location
+}
+
+type memUndo struct {
+	page, pos uint64
+	old       []byte
+}
+
+// Record keeps undo logs for the last n steps so the VM can go back with Back.
+// Registers, Pos, Page, Count, Stop, the call stack and the number of pages
+// are recorded automatically, memory writes are only recorded if the op uses Write or
+// Touch. Calling Record with 0 turns recording off.
+func (vm *VM) Record(n int) {
+	if n <= 0 {
+		vm.undo = nil
+		return
+	}
+	vm.undo = &undoLog{
+		entries: make([]undoEntry, n),
+	}
+}
+
+// Recorded returns the number of steps the VM can go back.
+func (vm *VM) Recorded() int {
+	if vm.undo == nil {
+		return 0
+	}
+	return vm.undo.n
+}
+
+// Touch records the size bytes at page, pos so a memory write can be undone
+// and traced, it should be called by an op before it changes memory. It does
+// nothing if the VM is not recording or tracing or the memory does not exist.
+func (vm *VM) Touch(page, pos, size uint64) {
+	recording := vm.undo != nil && vm.undo.active
+	tracing := vm.trace != nil && vm.trace.event != nil
+	if !recording && !tracing {
+		return
+	}
+	old, ok := vm.bytes(page, pos, size)
+	if !ok {
+		return
+	}
+	if recording {
+		e := vm.undo.last()
+		e.memory = append(e.memory, memUndo{
+			page: page,
+			pos:  pos,
+			old:  old,
+		})
+	}
+	if tracing {
+		e := vm.trace.event
+		e.Writes = append(e.Writes, MemoryWrite{
+			At:  Location{Page: page, Pos: pos},
+			Old: old,
+		})
+	}
+}
+
+// bytes returns a copy of size bytes of memory at page, pos or false if they do
+// not all exist.
+func (vm *VM) bytes(page, pos, size uint64) ([]byte, bool) {
+	if page >= uint64(len(vm.Pages)) {
+		return nil, false
+	}
+	p := vm.Pages[page]
+	end := pos + size
+	if pos >= uint64(len(p)) || end > uint64(len(p)) || end < pos {
+		return nil, false
+	}
+	return append([]byte(nil), p[pos:end]...), true
+}
+
+// Write puts q at page, pos, recording the old value if the VM is recording.
+// Like an index out of range, it panics if the 8 bytes are not all in the
+// page.
+func (vm *VM) Write(page, pos uint64, q Qword) {
+	p := vm.Pages[page]
+	// the max of len(p) makes the slice panic if pos+8 is past the end of
+	// the page, even when it is within its capacity
+	b := p[pos : pos+8 : len(p)]
+	vm.Touch(page, pos, 8)
+	q.Put(&b[0])
+}
+
+// Back undoes the last n steps. If fewer than n steps were recorded, it
+// returns ErrNoHistory and the VM is not changed.
+func (vm *VM) Back(n int) error {
+	if n > vm.Recorded() {
+		return ErrNoHistory
+	}
+	for ; n > 0; n-- {
+		vm.undo.back(vm)
+	}
+	if vm.watch != nil {
+		vm.watch.reset(vm)
+	}
+	return nil
+}
+
+// last returns the entry for the current step.
+func (u *undoLog) last() *undoEntry {
+	i := u.next - 1
+	if i < 0 {
+		i = len(u.entries) - 1
+	}
+	return &u.entries[i]
+}
+
+// begin starts the entry for a step, overwriting the oldest entry once the
+// buffer is full.
+func (u *undoLog) begin(vm *VM) {
+	e := &u.entries[u.next]
+	*e = undoEntry{
+		page:      vm.Page,
+		pos:       vm.Pos,
+		count:     vm.Count,
+		stop:      vm.Stop,
+		pages:     len(vm.Pages),
+		registers: e.registers[:0],
+		memory:    e.memory[:0],
+		stack:     len(vm.Stack),
+	}
+	if e.stack > 0 {
+		e.top = vm.Stack[e.stack-1]
+	}
+	u.next = (u.next + 1) % len(u.entries)
+	if u.n < len(u.entries) {
+		u.n++
+	}
+	u.regs = append(u.regs[:0], vm.Registers...)
+	u.active = true
+}
+
+// end records the registers the step changed.
+func (u *undoLog) end(vm *VM) {
+	u.active = false
+	e := u.last()
+	for r, old := range u.regs {
+		if r < len(vm.Registers) && vm.Registers[r] != old {
+			e.registers = append(e.registers, RegisterDelta{
+				Register: uint64(r),
+				Old:      old,
+				New:      vm.Registers[r],
+			})
+		}
+	}
+}
+
+// back undoes the last step and removes it from the log.
+func (u *undoLog) back(vm *VM) {
+	e := u.last()
+	for i := len(e.memory) - 1; i >= 0; i-- {
+		m := e.memory[i]
+		if m.page < uint64(len(vm.Pages)) {
+			copy(vm.Pages[m.page][m.pos:], m.old)
+		}
+	}
+	if e.pages < len(vm.Pages) {
+		vm.Pages = vm.Pages[:e.pages]
+	}
+	for _, d := range e.registers {
+		vm.Registers[d.Register] = d.Old
+	}
+	if e.stack > 0 {
+		vm.Stack = append(vm.Stack[:e.stack-1], e.top)
+	} else {
+		vm.Stack = vm.Stack[:0]
+	}
+	vm.Page, vm.Pos = e.page, e.pos
+	vm.Count, vm.Stop = e.count, e.stop
+	u.next = (u.next - 1 + len(u.entries)) % len(u.entries)
+	u.n--
+}
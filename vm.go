@@ -1,15 +1,61 @@
 package vm
 
+import (
+	"errors"
+	"time"
+)
+
+// Errors returned when the VM reaches one of its limits
+var (
+	ErrOutOfGas    = errors.New("out of gas")
+	ErrMemoryLimit = errors.New("memory limit exceeded")
+	ErrTimeout     = errors.New("timeout")
+)
+
+// deadlineMask sets how often Run checks the Deadline, it is checked when
+// Count&deadlineMask is 0.
+const deadlineMask = 1<<10 - 1
+
 // VM is a register machine with pages of memory and a slice of operations that
 // can execute a program.
+//
+// Count is the number of ops that have been started. If GasLimit is not 0, Run
+// returns ErrOutOfGas rather than start more than GasLimit ops. If MaxMemory is
+// not 0, Alloc will not let the total size of Pages go over it. If Deadline is
+// set, Run returns ErrTimeout once it has passed, it is checked every 1024 ops.
+//
+// Stack holds the locations to return to for each Call that has not returned,
+// it can not grow beyond MaxDepth, or DefaultMaxDepth if MaxDepth is 0.
+//
+// If a breakpoint or watchpoint fires, OnHit is called if it is set and Run
+// keeps going if it returns true, otherwise Run returns the Hit. Tracers set
+// with Trace are called around every op. Record keeps the history needed to
+// go back with Back.
+//
+// Floating point ops follow IEEE 754 binary64 with round to nearest, ties to
+// even, and keep subnormals and the sign of zero. Each op rounds its result
+// so ops are never fused, for instance into a multiply-add. The only part
+// that depends on the host is the sign and payload of a NaN, if StrictFloat is
+// set every NaN is CanonicalNaN so results are bit-identical everywhere.
 type VM struct {
-	Registers []Qword
-	Pages     [][]byte
-	Pos, Page uint64
-	Ops       []OpFunc
-	Panic     bool
-	Stop      bool
-	Extend    interface{}
+	Registers   []Qword
+	Pages       [][]byte
+	Pos, Page   uint64
+	Ops         []OpFunc
+	Panic       bool
+	Stop        bool
+	Extend      interface{}
+	Count       uint64
+	GasLimit    uint64
+	MaxMemory   uint64
+	Deadline    time.Time
+	StrictFloat bool
+	Stack       []Location
+	MaxDepth    int
+	OnHit       func(*Hit) bool
+	watch       *watcher
+	trace       *tracer
+	undo        *undoLog
 }
 
 // New creates a VM with the specified register values, program and ops
@@ -24,21 +70,119 @@ func New(registers []Qword, prog []byte, ops []OpFunc) *VM {
 // Run the VM
 func (vm *VM) Run() (err error) {
 	if !vm.Panic {
-		defer func() {
-			if r := recover(); r != nil {
-				if rerr, ok := r.(error); ok {
-					err = rerr
-				} else {
-					panic(r)
-				}
-			}
-		}()
+		defer vm.recover(&err)
 	}
+	if vm.hooked() {
+		return vm.runHooked()
+	}
+	return vm.run()
+}
+
+func (vm *VM) run() error {
 	for {
+		if vm.GasLimit != 0 && vm.Count >= vm.GasLimit {
+			return ErrOutOfGas
+		}
+		if vm.Count&deadlineMask == 0 && !vm.Deadline.IsZero() && time.Now().After(vm.Deadline) {
+			return ErrTimeout
+		}
 		op := GetOp(&vm.Pages[vm.Page][vm.Pos])
-		err = vm.Ops[op](vm)
+		vm.Count++
+		err := vm.Ops[op](vm)
 		if err != nil || vm.Stop {
-			return
+			return err
+		}
+	}
+}
+
+// Step runs a single op, it returns the same errors as Run. Breakpoints are
+// ignored but watchpoints are checked.
+func (vm *VM) Step() (err error) {
+	if !vm.Panic {
+		defer vm.recover(&err)
+	}
+	at := Location{Page: vm.Page, Pos: vm.Pos}
+	if err := vm.step(); err != nil {
+		return err
+	}
+	if vm.watch != nil {
+		vm.watch.skip = nil
+		if h := vm.checkWatches(at); h != nil && !vm.hit(h) {
+			return h
+		}
+	}
+	return nil
+}
+
+func (vm *VM) step() error {
+	if vm.GasLimit != 0 && vm.Count >= vm.GasLimit {
+		return ErrOutOfGas
+	}
+	if vm.Count&deadlineMask == 0 && !vm.Deadline.IsZero() && time.Now().After(vm.Deadline) {
+		return ErrTimeout
+	}
+	op := GetOp(&vm.Pages[vm.Page][vm.Pos])
+	if vm.undo != nil {
+		vm.undo.begin(vm)
+		defer vm.undo.end(vm)
+	}
+	vm.Count++
+	if vm.trace != nil {
+		return vm.trace.step(vm, op)
+	}
+	return vm.Ops[op](vm)
+}
+
+// hooked returns true if Run needs to use runHooked.
+func (vm *VM) hooked() bool {
+	return vm.watch != nil || vm.trace != nil || vm.undo != nil
+}
+
+// runHooked is Run when there are breakpoints, watchpoints, tracers or undo
+// logs.
+func (vm *VM) runHooked() error {
+	for {
+		at := Location{Page: vm.Page, Pos: vm.Pos}
+		if h := vm.checkBreakpoint(at); h != nil && !vm.hit(h) {
+			return h
+		}
+		if err := vm.step(); err != nil || vm.Stop {
+			return err
+		}
+		if h := vm.checkWatches(at); h != nil && !vm.hit(h) {
+			return h
+		}
+		if !vm.hooked() {
+			return vm.run()
+		}
+	}
+}
+
+// recover turns a panic with an error into a returned error, it must be
+// deferred.
+func (vm *VM) recover(err *error) {
+	if r := recover(); r != nil {
+		if rerr, ok := r.(error); ok {
+			*err = rerr
+		} else {
+			panic(r)
+		}
+	}
+}
+
+// Alloc adds a page of the given size and returns its page number. It returns
+// ErrMemoryLimit if the page would take the total size of Pages over
+// MaxMemory.
+func (vm *VM) Alloc(size uint64) (uint64, error) {
+	if vm.MaxMemory != 0 {
+		total := size
+		for _, p := range vm.Pages {
+			total += uint64(len(p))
+		}
+		if total > vm.MaxMemory || total < size {
+			return 0, ErrMemoryLimit
 		}
 	}
+	vm.Pages = append(vm.Pages, make([]byte, size))
+	return uint64(len(vm.Pages) - 1), nil
 }
@@ -1,10 +1,18 @@
 package vmtest
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"github.com/dist-ribut-us/vm"
 	"github.com/dist-ribut-us/vm/ops"
 	"github.com/stretchr/testify/assert"
+	"io"
+	"math"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"time"
 )
 
 func TestBasic(t *testing.T) {
@@ -110,3 +118,1080 @@ func TestVar(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, vm.Qword(28), v.Registers[2])
 }
+
+func TestRegAlias(t *testing.T) {
+	// compute AxB
+	parser := ops.List.Parser()
+	p, err := parser(`
+		#def  A 7
+		#def  B 4
+		#reg  a     0
+		#reg  b     1
+		#reg  total 2
+		set   a A
+		set   b B
+		loop:
+		iadd  total a
+		isubv b 1
+		jumpv b 0 loop
+		#unreg total
+		stop
+	`)
+	assert.NoError(t, err)
+	v := vm.New([]vm.Qword{0, 0, 0}, p, ops.List.Ops())
+	v.Panic = true
+
+	err = v.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, vm.Qword(28), v.Registers[2])
+
+	// a definition can be used as a register and a number once its alias is
+	// removed
+	p, err = parser("#reg a 0 \n #unreg a \n #def R 1 \n set R 5 \n set 0 1 \n stop")
+	assert.NoError(t, err)
+	v = vm.New([]vm.Qword{0, 0}, p, ops.List.Ops())
+	assert.NoError(t, v.Run())
+	assert.Equal(t, vm.Qword(5), v.Registers[1])
+
+	for _, code := range []string{
+		"#reg a 0 \n set 1 a",             // alias used as value
+		"#reg a 0 \n set 0 5",             // number of a register with an alias
+		"loop: \n set loop 5",             // label used as register
+		"#section s \n set s 5",           // section used as register
+		"#reg a 0 \n #unreg a \n set a 1", // alias used after #unreg
+		"#reg a 0 \n #reg a 1",            // alias redefined
+		"#def A 7 \n #reg A 1",            // alias shadows definition
+		"#reg a 1.5",                      // register must be an integer
+		"#unreg a",                        // alias not defined
+	} {
+		_, err = parser(code)
+		assert.Error(t, err, code)
+	}
+}
+
+func TestMacro(t *testing.T) {
+	// compute AxB twice using a macro with a local label
+	parser := ops.List.Parser()
+	p, err := parser(`
+		#macro mult dst a b
+			set   dst 0
+			loop:
+			iadd  dst a
+			isubv b 1
+			jumpv b 0 loop
+		#endmacro
+		#macro setmult dst a av b bv
+			set  a av
+			set  b bv
+			mult dst a b
+		#endmacro
+		setmult 2 0 7 1 4
+		setmult 3 0 5 1 6
+		stop
+	`)
+	assert.NoError(t, err)
+	v := vm.New([]vm.Qword{0, 0, 0, 0}, p, ops.List.Ops())
+	v.Panic = true
+
+	err = v.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, vm.Qword(28), v.Registers[2])
+	assert.Equal(t, vm.Qword(30), v.Registers[3])
+
+	// the page of a param or of a label in the macro can be used
+	pages, err := ops.List.Assembler().AssemblePages("", `
+		#macro go t
+			jmp @t t
+		#endmacro
+		#macro skip
+			jmp @over over
+			set 0 1
+			over:
+		#endmacro
+		skip
+		go far
+		#page 1
+		far:
+		set 1 2
+		stop
+	`)
+	assert.NoError(t, err)
+	v = vm.New([]vm.Qword{0, 0}, pages[0], ops.List.Ops())
+	v.Pages = pages
+	assert.NoError(t, v.Run())
+	assert.Equal(t, []vm.Qword{0, 2}, v.Registers)
+
+	_, err = parser(`
+		#macro bad r
+			set r 1.2.3
+		#endmacro
+		bad 0
+	`)
+	if assert.Error(t, err) {
+		le, ok := err.(vm.LineError)
+		if assert.True(t, ok) && assert.NotNil(t, le.Call) {
+			assert.Equal(t, 2, le.LineNumber)
+			assert.Equal(t, 4, le.Call.LineNumber)
+		}
+	}
+
+	for _, code := range []string{
+		"#macro r \n r \n #endmacro \n r", // recursive
+		"#macro m \n stop",                // missing #endmacro
+		"#endmacro",                       // missing #macro
+		"#macro set \n #endmacro",         // name is an op
+		"#macro m a \n #endmacro \n m",    // wrong number of args
+	} {
+		_, err = parser(code)
+		assert.Error(t, err, code)
+	}
+
+	// each macro invokes the next four times, without a limit on the total
+	// number of expansions this would be 4^15 lines
+	var chain strings.Builder
+	for i := 0; i < 15; i++ {
+		fmt.Fprintf(&chain, "#macro m%d\n", i)
+		for j := 0; j < 4; j++ {
+			fmt.Fprintf(&chain, "m%d\n", i+1)
+		}
+		chain.WriteString("#endmacro\n")
+	}
+	chain.WriteString("#macro m15\nstop\n#endmacro\nm0")
+	_, err = parser(chain.String())
+	if le, ok := err.(vm.LineError); assert.True(t, ok) {
+		assert.Equal(t, "Too many macro expansions", le.ErrorType)
+	}
+}
+
+func TestInclude(t *testing.T) {
+	a := ops.List.Assembler()
+	a.FS = fstest.MapFS{
+		"main.vm": {Data: []byte(`
+			#include "lib/mult.vm"
+			set  0 A
+			set  1 B
+			mult 2 0 1
+			stop
+		`)},
+		"lib/mult.vm": {Data: []byte(`
+			#include "consts.vm"
+			#macro mult dst a b
+				loop:
+				iadd  dst a
+				isubv b 1
+				jumpv b 0 loop
+			#endmacro
+		`)},
+		"lib/consts.vm": {Data: []byte(`
+			#def A 7
+			#def B 4
+		`)},
+		"cycle.vm":   {Data: []byte(`#include "cycle2.vm"`)},
+		"cycle2.vm":  {Data: []byte(`#include "cycle.vm"`)},
+		"badline.vm": {Data: []byte("stop\nnotanop 1")},
+	}
+
+	p, err := a.AssembleFile("main.vm")
+	assert.NoError(t, err)
+	v := vm.New([]vm.Qword{0, 0, 0}, p, ops.List.Ops())
+	v.Panic = true
+	err = v.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, vm.Qword(28), v.Registers[2])
+
+	_, err = a.AssembleFile("cycle.vm")
+	assert.Error(t, err)
+
+	_, err = a.Assemble("", `#include "badline.vm"`)
+	if assert.Error(t, err) {
+		le, ok := err.(vm.LineError)
+		if assert.True(t, ok) {
+			assert.Equal(t, "badline.vm", le.File)
+			assert.Equal(t, 1, le.LineNumber)
+			assert.Equal(t, "badline.vm:2", le.Position())
+		}
+	}
+
+	_, err = a.Assemble("", `#include "missing.vm"`)
+	assert.Error(t, err)
+
+	_, err = ops.List.Parser()(`#include "main.vm"`)
+	assert.Error(t, err)
+}
+
+func TestLocalLabels(t *testing.T) {
+	// compute AxB and CxD with two functions that both use .loop
+	parser := ops.List.Parser()
+	p, err := parser(`
+		set   0 7
+		set   1 4
+		set   3 5
+		set   4 6
+		first:
+		iadd  2 0
+		isubv 1 1
+		jumpv 1 0 .loop
+		.loop:
+		jumpv 1 0 first
+		second:
+		.loop:
+		iadd  5 3
+		isubv 4 1
+		jumpv 4 0 .loop
+		stop
+	`)
+	assert.NoError(t, err)
+	v := vm.New([]vm.Qword{0, 0, 0, 0, 0, 0}, p, ops.List.Ops())
+	v.Panic = true
+
+	err = v.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, vm.Qword(28), v.Registers[2])
+	assert.Equal(t, vm.Qword(30), v.Registers[5])
+
+	for _, code := range []string{
+		"a: \n a:",                        // duplicate label
+		"#def A 1 \n #def A 2",            // duplicate definition
+		"#def A 1 \n A:",                  // label and definition collide
+		"a: \n .x: \n .x:",                // duplicate local label
+		"a: \n .x: \n b: \n jumpv 0 0 .x", // local label out of scope
+		"jumpv 0 0 missing",               // undefined label
+	} {
+		_, err = parser(code)
+		assert.Error(t, err, code)
+	}
+
+	// with several undefined names the same one is reported every time
+	for i := 0; i < 10; i++ {
+		_, err = parser("set 0 zz \n set 0 mm \n set 0 aa \n set 0 qq \n stop")
+		if le, ok := err.(vm.LineError); assert.True(t, ok) {
+			assert.Equal(t, "Not defined", le.ErrorType)
+			assert.Equal(t, "set 0 aa", le.LineString)
+		}
+	}
+}
+
+func TestData(t *testing.T) {
+	parser := ops.List.Parser()
+	p, err := parser(`
+		#def  N 3
+		set   1 0
+		set   2 table
+		read  3 1 2
+		iaddv 2 8
+		read  4 1 2
+		set   2 floats
+		read  5 1 2
+		set   2 neg
+		read  6 1 2
+		set   2 ptr
+		read  7 1 2
+		stop
+		#bytes  1 2 3
+		#align  8
+		table:
+		#qword  10 N
+		floats:
+		#float  2 1.5
+		neg:
+		#qword  -1
+		ptr:
+		#qword  str
+		str:
+		#string "hi\n"
+		#zero   5
+		end:
+	`)
+	assert.NoError(t, err)
+	v := vm.New(make([]vm.Qword, 8), p, ops.List.Ops())
+	v.Panic = true
+
+	err = v.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, vm.Qword(10), v.Registers[3])
+	assert.Equal(t, vm.Qword(3), v.Registers[4])
+	assert.Equal(t, 2.0, v.Registers[5].GetF())
+	assert.Equal(t, ^vm.Qword(0), v.Registers[6])
+	str := v.Registers[7]
+	assert.Equal(t, "hi\n", string(p[str:str+3]))
+	assert.Len(t, p, int(str)+8)
+	assert.Equal(t, 0, int(str-8)%8)
+
+	for _, code := range []string{
+		"#bytes 256",
+		"#float abc",
+		"#string hi",
+		"#align 0",
+		"#zero",
+		"#qword missing",
+	} {
+		_, err = parser(code)
+		assert.Error(t, err, code)
+	}
+}
+
+func TestSections(t *testing.T) {
+	a := ops.List.Assembler()
+	pages, err := a.AssemblePages("", `
+		set   0 1
+		set   1 @table
+		set   2 table
+		read  3 1 2
+		set   2 out
+		jumpv 0 @more more
+		#section data
+		table:
+		#qword 42
+		out:
+		#zero  8
+		#section code
+		more:
+		write 3 1 2
+		set   4 data
+		set   5 code
+		stop
+	`)
+	assert.NoError(t, err)
+	if !assert.Len(t, pages, 3) {
+		return
+	}
+	v := vm.New(make([]vm.Qword, 6), pages[0], ops.List.Ops())
+	v.Pages = pages
+	v.Panic = true
+
+	err = v.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, vm.Qword(42), v.Registers[3])
+	assert.Equal(t, vm.Qword(1), v.Registers[4])
+	assert.Equal(t, vm.Qword(2), v.Registers[5])
+	assert.Equal(t, vm.Qword(42), vm.Get(&v.Pages[1][8]))
+	assert.Equal(t, uint64(2), v.Page)
+
+	_, err = a.Assemble("", "#page 1 \n stop")
+	assert.Error(t, err)
+	_, err = a.Assemble("", "#def A 1 \n set 0 @A")
+	assert.Error(t, err)
+}
+
+func TestLink(t *testing.T) {
+	a := ops.List.Assembler()
+	main, err := a.Object("main.vm", `
+		set   0 1
+		set   1 @start
+		set   2 start
+		jumpv 0 @lib lib
+		start:
+		set   3 @value
+		set   4 value
+		read  4 3 4
+		stop
+	`)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"lib", "value"}, main.Imports)
+
+	lib, err := a.Object("lib.vm", `
+		#export lib
+		#export value
+		#section libcode
+		lib:
+		set   5 N
+		jump  0 1 2
+		#section data
+		#def  N 99
+		#zero 16
+		value:
+		#qword 123
+	`)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, lib.Encode(&buf))
+	lib, err = vm.DecodeObject(&buf)
+	assert.NoError(t, err)
+
+	pages, err := vm.Link(main, lib)
+	assert.NoError(t, err)
+	if !assert.Len(t, pages, 3) {
+		return
+	}
+	v := vm.New(make([]vm.Qword, 6), pages[0], ops.List.Ops())
+	v.Pages = pages
+	v.Panic = true
+	err = v.Run()
+	assert.NoError(t, err)
+	assert.Equal(t, vm.Qword(123), v.Registers[4])
+	assert.Equal(t, vm.Qword(99), v.Registers[5])
+
+	_, err = vm.Link(main)
+	if assert.Error(t, err) {
+		le, ok := err.(vm.LinkError)
+		if assert.True(t, ok) {
+			assert.Equal(t, []string{"lib (main.vm)", "value (main.vm)"}, le.Unresolved)
+		}
+	}
+
+	_, err = vm.Link(main, lib, lib)
+	if assert.Error(t, err) {
+		le, ok := err.(vm.LinkError)
+		if assert.True(t, ok) {
+			assert.Len(t, le.Duplicate, 2)
+		}
+	}
+
+	_, err = a.Object("", "#page 1")
+	assert.Error(t, err)
+	_, err = a.Object("", "#export missing")
+	assert.Error(t, err)
+
+	// objects that refer to sections or positions that do not exist
+	for _, bad := range []*vm.Object{
+		{Sections: []vm.Section{{Data: []byte{0}}}, Relocs: []vm.Reloc{{Pos: 100, Symbol: "x"}}},
+		{Sections: []vm.Section{{Data: make([]byte, 8)}}, Relocs: []vm.Reloc{{Pos: 1, Symbol: "x"}}},
+		{Sections: []vm.Section{{Data: make([]byte, 8)}}, Relocs: []vm.Reloc{{Section: 1, Symbol: "x"}}},
+		{Sections: []vm.Section{{}}, Symbols: []vm.Symbol{{Name: "x", Kind: vm.SymbolLabel, Section: 3}}},
+	} {
+		_, err = vm.Link(bad)
+		assert.Equal(t, vm.ErrBadObject, err)
+		buf.Reset()
+		assert.NoError(t, bad.Encode(&buf))
+		_, err = vm.DecodeObject(&buf)
+		assert.Equal(t, vm.ErrBadObject, err)
+	}
+}
+
+func TestLinkAlign(t *testing.T) {
+	a := ops.List.Assembler()
+	main, err := a.Object("main.vm", `
+		#section data
+		#bytes 1 2 3
+	`)
+	assert.NoError(t, err)
+	lib, err := a.Object("lib.vm", `
+		#export val
+		#section data
+		#align 8
+		val:
+		#qword 5
+	`)
+	assert.NoError(t, err)
+	assert.Equal(t, 8, lib.Sections[1].Align)
+
+	pages, err := vm.Link(main, lib)
+	assert.NoError(t, err)
+	if assert.Len(t, pages, 2) {
+		assert.Equal(t, []byte{1, 2, 3, 0, 0, 0, 0, 0, 5, 0, 0, 0, 0, 0, 0, 0}, pages[1])
+	}
+
+	use, err := a.Object("use.vm", `
+		set 0 val
+		stop
+	`)
+	assert.NoError(t, err)
+	pages, err = vm.Link(use, main, lib)
+	assert.NoError(t, err)
+	v := vm.New(make([]vm.Qword, 1), pages[0], ops.List.Ops())
+	v.Pages = pages
+	assert.NoError(t, v.Run())
+	assert.Equal(t, vm.Qword(8), v.Registers[0])
+}
+
+func TestDisassemble(t *testing.T) {
+	parser := ops.List.Parser()
+	p, err := parser(`
+		#def  A 7
+		set   0 A
+		set   1 -4
+		set   2 12.5
+		set   3 -0.25
+		set   4 12345678901234
+		loop:
+		iadd  2 0
+		isubv 1 1
+		jumpv 1 0 loop
+		jumpv 1 0 end
+		stop
+		end:
+		#bytes 1 2 3
+	`)
+	assert.NoError(t, err)
+
+	code, err := vm.Disassemble(p, ops.List)
+	assert.NoError(t, err)
+	assert.Contains(t, code, "set 2 12.5\n")
+	assert.Contains(t, code, "set 3 -0.25\n")
+	assert.Contains(t, code, "set 1 -4\n")
+	assert.Contains(t, code, "jumpv 1 0 L90\n")
+	assert.Contains(t, code, "L90:\n")
+
+	p2, err := parser(code)
+	assert.NoError(t, err)
+	assert.Equal(t, p, p2)
+}
+
+func TestDebugInfo(t *testing.T) {
+	a := ops.List.Assembler()
+	pages, d, err := a.AssembleDebug("script.vm", `
+		#def  A 7
+		set   0 A
+		set   1 4
+		loop:
+		iadd  2 0
+		isubv 1 1
+		jumpv 1 0 loop
+		stop
+		#section data
+		table:
+		#qword 1 2
+	`)
+	assert.NoError(t, err)
+	assert.Len(t, pages, 2)
+
+	li, ok := d.Line(0, 36)
+	assert.True(t, ok)
+	assert.Equal(t, vm.LineInfo{Page: 0, Pos: 36, File: "script.vm", Line: 6, Op: true}, li)
+	li, ok = d.Line(0, 60)
+	assert.True(t, ok)
+	assert.Equal(t, 7, li.Line)
+	_, ok = d.Line(2, 0)
+	assert.False(t, ok)
+
+	assert.Equal(t, "loop+18 (script.vm:7)", d.Describe(0, 54))
+	assert.Equal(t, "table+8 (script.vm:12)", d.Describe(1, 8))
+	assert.Equal(t, "0:0 (script.vm:3)", d.Describe(0, 0))
+
+	names := make([]string, len(d.Symbols))
+	for i, s := range d.Symbols {
+		names[i] = s.Name
+	}
+	assert.Equal(t, []string{"A", "data", "loop", "table"}, names)
+}
+
+func TestFormat(t *testing.T) {
+	src := `
+// compute AxB
+  #DEF  A 7
+		#def  LONGNAME 4
+		set   0 A // first
+		set 1 LONGNAME
+		loop:
+		iadd  2 0
+		isubv 1 1   // decrement
+
+
+		#macro m a
+		  set a 1
+		#endmacro
+		stop//done
+	`
+	expected := `// compute AxB
+	#def  A        7
+	#def  LONGNAME 4
+	set   0 A // first
+	set   1 LONGNAME
+loop:
+	iadd  2 0
+	isubv 1 1 // decrement
+
+	#macro m a
+		set  a 1
+	#endmacro
+	stop //done
+`
+	out := vm.Format(src)
+	assert.Equal(t, expected, out)
+	assert.Equal(t, out, vm.Format(out))
+
+	// formatting does not change what the source assembles to
+	parser := ops.List.Parser()
+	p, err := parser(src)
+	assert.NoError(t, err)
+	p2, err := parser(out)
+	assert.NoError(t, err)
+	assert.Equal(t, p, p2)
+}
+
+func TestListing(t *testing.T) {
+	a := ops.List.Assembler()
+	l, err := a.Listing("", `
+		#def  A 7
+		set   0 A
+		loop:
+		jumpv 0 0 loop
+		#qword loop
+	`)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(l), "\n")
+	if assert.Len(t, lines, 5) {
+		assert.Contains(t, lines[1], "0:0 ")
+		assert.Contains(t, lines[1], "0100 0000000000000000 0700000000000000")
+		assert.Contains(t, lines[1], "; set 0 7")
+		assert.Contains(t, lines[3], "0:18 ")
+		assert.Contains(t, lines[3], "; jumpv 0 0 18")
+		assert.Contains(t, lines[4], "1200000000000000")
+		assert.Contains(t, lines[4], "; #qword 18")
+	}
+}
+
+func TestDefines(t *testing.T) {
+	a := ops.List.Assembler()
+	n, err := vm.ParseValue("2.5")
+	assert.NoError(t, err)
+	a.Defines = map[string]vm.Qword{"N": n}
+	p, err := a.Assemble("", `
+		set 0 N
+		stop
+	`)
+	assert.NoError(t, err)
+	v := vm.New([]vm.Qword{0}, p, ops.List.Ops())
+	assert.NoError(t, v.Run())
+	assert.Equal(t, 2.5, v.Registers[0].GetF())
+
+	// a define overrides a #def of the same name in the code
+	p, err = a.Assemble("", `
+		#def N 5
+		set  0 N
+		stop
+	`)
+	assert.NoError(t, err)
+	v = vm.New([]vm.Qword{0}, p, ops.List.Ops())
+	assert.NoError(t, v.Run())
+	assert.Equal(t, 2.5, v.Registers[0].GetF())
+
+	for _, code := range []string{
+		"#def N 1 \n #def N 2", // still only one #def
+		"N:",                   // a label is not overridden
+	} {
+		_, err = a.Assemble("", code)
+		assert.Error(t, err, code)
+	}
+	for _, name := range []string{"5", ".x", ""} {
+		a.Defines = map[string]vm.Qword{name: 1}
+		_, err = a.Assemble("", "stop")
+		assert.Error(t, err, name)
+	}
+	_, err = vm.ParseValue("N")
+	assert.Error(t, err)
+}
+
+func TestProgramFormat(t *testing.T) {
+	pages := [][]byte{{1, 2, 3}, nil, {4}}
+	var buf bytes.Buffer
+	assert.NoError(t, vm.WriteProgram(&buf, pages))
+	got, err := vm.ReadProgram(&buf)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{{1, 2, 3}, {}, {4}}, got)
+
+	_, err = vm.ReadProgram(strings.NewReader("nope"))
+	assert.Error(t, err)
+
+	// a huge page size must be an error, not a panic
+	huge := append([]byte("vmprg1"), 1)
+	huge = binary.AppendUvarint(huge, 1<<62)
+	_, err = vm.ReadProgram(bytes.NewReader(append(huge, 1, 2, 3)))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+	huge = append([]byte("vmprg1"), 1)
+	huge = binary.AppendUvarint(huge, math.MaxUint64)
+	_, err = vm.ReadProgram(bytes.NewReader(huge))
+	assert.Error(t, err)
+}
+
+func TestLimits(t *testing.T) {
+	parser := ops.List.Parser()
+	loop, err := parser(`
+		set   0 1
+		loop:
+		jumpv 0 0 loop
+	`)
+	assert.NoError(t, err)
+
+	v := vm.New([]vm.Qword{0}, loop, ops.List.Ops())
+	v.GasLimit = 100
+	assert.Equal(t, vm.ErrOutOfGas, v.Run())
+	assert.Equal(t, uint64(100), v.Count)
+
+	v = vm.New([]vm.Qword{0}, loop, ops.List.Ops())
+	v.Deadline = time.Now().Add(10 * time.Millisecond)
+	assert.Equal(t, vm.ErrTimeout, v.Run())
+
+	p, err := parser(`
+		set   0 100
+		alloc 0
+		set   0 100
+		alloc 0
+		stop
+	`)
+	assert.NoError(t, err)
+	v = vm.New([]vm.Qword{0}, p, ops.List.Ops())
+	v.MaxMemory = 250
+	assert.Equal(t, vm.ErrMemoryLimit, v.Run())
+	assert.Len(t, v.Pages, 2)
+	assert.Equal(t, uint64(46), v.Pos)
+}
+
+func TestBreakpoints(t *testing.T) {
+	parser := ops.List.Parser()
+	p, err := parser(`
+		set   0 7
+		set   1 4
+		set   3 8
+		alloc 3
+		set   4 0
+		loop:
+		iadd  2 0
+		isubv 1 1
+		jumpv 1 0 loop
+		write 2 3 4
+		stop
+	`)
+	assert.NoError(t, err)
+	v := vm.New(make([]vm.Qword, 5), p, ops.List.Ops())
+	v.SetBreakpoint(0, 82)
+
+	for i := 0; i < 4; i++ {
+		err = v.Run()
+		if assert.IsType(t, &vm.Hit{}, err) {
+			assert.Equal(t, vm.BreakpointHit, err.(*vm.Hit).Kind)
+		}
+		assert.Equal(t, vm.Qword(7*i), v.Registers[2])
+	}
+	v.ClearBreakpoint(0, 82)
+
+	v.WatchMemory(1, 0, 8)
+	err = v.Run()
+	if assert.IsType(t, &vm.Hit{}, err) {
+		h := err.(*vm.Hit)
+		assert.Equal(t, vm.MemoryHit, h.Kind)
+		assert.Equal(t, vm.Location{Page: 0, Pos: 144}, h.At)
+		assert.Equal(t, []byte{28, 0, 0, 0, 0, 0, 0, 0}, h.New)
+	}
+	assert.NoError(t, v.Run())
+
+	// OnHit can keep the VM running
+	v = vm.New(make([]vm.Qword, 5), p, ops.List.Ops())
+	var changes int
+	v.WatchRegister(2)
+	v.OnHit = func(h *vm.Hit) bool {
+		changes++
+		return true
+	}
+	assert.NoError(t, v.Run())
+	assert.Equal(t, 4, changes)
+}
+
+type countTracer struct {
+	before, after int
+	names         []string
+}
+
+func (ct *countTracer) Before(v *vm.VM, e *vm.TraceEvent) {
+	ct.before++
+}
+
+func (ct *countTracer) After(v *vm.VM, e *vm.TraceEvent) {
+	ct.after++
+	ct.names = append(ct.names, e.Name)
+}
+
+func TestTrace(t *testing.T) {
+	parser := ops.List.Parser()
+	p, err := parser(`
+		set   0 3
+		set   1 2
+		loop:
+		iadd  2 0
+		isubv 1 1
+		jumpv 1 0 loop
+		stop
+	`)
+	assert.NoError(t, err)
+
+	v := vm.New(make([]vm.Qword, 3), p, ops.List.Ops())
+	var js, bin bytes.Buffer
+	ct := &countTracer{}
+	v.Trace(ops.List, ct, vm.JSONTracer(&js), vm.BinaryTracer(&bin))
+	assert.NoError(t, v.Run())
+	assert.Equal(t, vm.Qword(6), v.Registers[2])
+	assert.Equal(t, 9, ct.before)
+	assert.Equal(t, 9, ct.after)
+	assert.Equal(t, []string{"set", "set", "iadd", "isubv", "jumpv", "iadd", "isubv", "jumpv", "stop"}, ct.names)
+
+	lines := strings.Split(strings.TrimSpace(js.String()), "\n")
+	assert.Len(t, lines, 9)
+	assert.Equal(t, `{"count":3,"page":0,"pos":36,"op":3,"name":"iadd","args":[2,0],"deltas":[{"reg":2,"old":0,"new":3}]}`, lines[2])
+
+	es, err := vm.ReadTrace(&bin)
+	assert.NoError(t, err)
+	if assert.Len(t, es, 9) {
+		assert.Equal(t, uint64(4), es[3].Count)
+		assert.Equal(t, vm.Location{Page: 0, Pos: 54}, es[3].At)
+		assert.Equal(t, []vm.Qword{1, 1}, es[3].Args)
+		assert.Equal(t, []vm.RegisterDelta{{Register: 1, Old: 2, New: 1}}, es[3].Deltas)
+	}
+
+	// faults are traced
+	p, err = parser(`
+		set  0 9
+		read 1 0 0
+	`)
+	assert.NoError(t, err)
+	v = vm.New(make([]vm.Qword, 2), p, ops.List.Ops())
+	bin.Reset()
+	v.Trace(ops.List, vm.BinaryTracer(&bin))
+	assert.Error(t, v.Run())
+	es, err = vm.ReadTrace(&bin)
+	assert.NoError(t, err)
+	if assert.Len(t, es, 2) {
+		assert.Error(t, es[1].Err)
+	}
+
+	_, err = vm.ReadTrace(strings.NewReader("not a trace"))
+	assert.Equal(t, vm.ErrNotTrace, err)
+}
+
+func TestBack(t *testing.T) {
+	parser := ops.List.Parser()
+	p, err := parser(`
+		set   0 7
+		set   1 4
+		set   3 8
+		alloc 3
+		set   4 0
+		loop:
+		iadd  2 0
+		write 2 3 4
+		isubv 1 1
+		jumpv 1 0 loop
+		stop
+	`)
+	assert.NoError(t, err)
+	v := vm.New(make([]vm.Qword, 5), p, ops.List.Ops())
+	v.Record(8)
+	assert.NoError(t, v.Run())
+	assert.Equal(t, vm.Qword(28), v.Registers[2])
+	assert.Equal(t, vm.Qword(28), vm.Get(&v.Pages[1][0]))
+	assert.Equal(t, 8, v.Recorded())
+
+	// back over stop, jumpv, isubv and write
+	assert.NoError(t, v.Back(4))
+	assert.False(t, v.Stop)
+	assert.Equal(t, uint64(18), v.Count)
+	assert.Equal(t, uint64(100), v.Pos)
+	assert.Equal(t, vm.Qword(28), v.Registers[2])
+	assert.Equal(t, vm.Qword(1), v.Registers[1])
+	assert.Equal(t, vm.Qword(21), vm.Get(&v.Pages[1][0]))
+
+	// only 8 steps are kept
+	assert.Equal(t, vm.ErrNoHistory, v.Back(5))
+	assert.NoError(t, v.Back(4))
+	assert.Equal(t, vm.Qword(14), vm.Get(&v.Pages[1][0]))
+	assert.Equal(t, 0, v.Recorded())
+
+	// running again gives the same result
+	assert.NoError(t, v.Run())
+	assert.Equal(t, vm.Qword(28), v.Registers[2])
+	assert.Equal(t, vm.Qword(28), vm.Get(&v.Pages[1][0]))
+	assert.Equal(t, uint64(22), v.Count)
+
+	// alloc is undone
+	v = vm.New(make([]vm.Qword, 5), p, ops.List.Ops())
+	v.Record(100)
+	assert.NoError(t, v.Run())
+	assert.NoError(t, v.Back(v.Recorded()))
+	assert.Len(t, v.Pages, 1)
+	assert.Equal(t, make([]vm.Qword, 5), v.Registers)
+	assert.Equal(t, uint64(0), v.Count)
+
+	// a write that straddles the end of a page fails and changes nothing
+	p, err = parser(`
+		set   0 4
+		alloc 0
+		set   1 2
+		set   2 -1
+		write 2 0 1
+		stop
+	`)
+	assert.NoError(t, err)
+	v = vm.New(make([]vm.Qword, 3), p, ops.List.Ops())
+	v.Record(8)
+	assert.Error(t, v.Run())
+	assert.Equal(t, []byte{0, 0, 0, 0}, v.Pages[1])
+
+	// even if the page has the capacity
+	v.Pages[1] = make([]byte, 4, 16)
+	assert.Panics(t, func() { v.Write(1, 2, 1) })
+	assert.Equal(t, make([]byte, 16), v.Pages[1][:16])
+}
+
+func TestTranscript(t *testing.T) {
+	parser := ops.List.Parser()
+	p, err := parser(`
+		set   1 4
+		set   3 8
+		alloc 3
+		set   4 0
+		loop:
+		iadd  2 0
+		write 2 3 4
+		isubv 1 1
+		jumpv 1 0 loop
+		stop
+	`)
+	assert.NoError(t, err)
+	run := func(r0 vm.Qword) *vm.Transcript {
+		v := vm.New(make([]vm.Qword, 5), p, ops.List.Ops())
+		v.Registers[0] = r0
+		ts := vm.NewTranscript()
+		ts.Interval = 4
+		v.Trace(ops.List, ts)
+		assert.NoError(t, v.Run())
+		return ts
+	}
+
+	a, b := run(7), run(7)
+	assert.Equal(t, a.Sum(), b.Sum())
+	assert.Equal(t, a.Checkpoints, b.Checkpoints)
+	assert.Len(t, a.Checkpoints, 5)
+	_, diverged := vm.Diverged(a.Checkpoints, b.Checkpoints)
+	assert.False(t, diverged)
+
+	// the first change is the iadd at count 5 so the first checkpoint matches
+	c := run(8)
+	assert.NotEqual(t, a.Sum(), c.Sum())
+	at, diverged := vm.Diverged(a.Checkpoints, c.Checkpoints)
+	assert.True(t, diverged)
+	assert.Equal(t, uint64(8), at)
+	assert.Equal(t, a.Checkpoints[0], c.Checkpoints[0])
+
+	// memory writes are traced
+	var js, bin bytes.Buffer
+	v := vm.New(make([]vm.Qword, 5), p, ops.List.Ops())
+	v.Registers[0] = 7
+	v.Trace(ops.List, vm.JSONTracer(&js), vm.BinaryTracer(&bin))
+	assert.NoError(t, v.Run())
+	lines := strings.Split(js.String(), "\n")
+	assert.Contains(t, lines[5], `"writes":[{"page":1,"pos":0,"old":"0000000000000000","new":"0700000000000000"}]`)
+	es, err := vm.ReadTrace(&bin)
+	assert.NoError(t, err)
+	if assert.Len(t, es, 21) {
+		assert.Equal(t, []vm.MemoryWrite{{
+			At:  vm.Location{Page: 1, Pos: 0},
+			Old: []byte{7, 0, 0, 0, 0, 0, 0, 0},
+			New: []byte{14, 0, 0, 0, 0, 0, 0, 0},
+		}}, es[9].Writes)
+	}
+}
+
+func TestRelative(t *testing.T) {
+	code := `
+		set   0 3
+		br    .loop
+		.back:
+		iaddv 1 1
+		isubv 0 1
+		.loop:
+		brnz  0 .back
+		stop
+	`
+	parser := ops.List.Parser()
+	p, err := parser("f:" + code)
+	assert.NoError(t, err)
+	v := vm.New(make([]vm.Qword, 2), p, ops.List.Ops())
+	assert.NoError(t, v.Run())
+	assert.Equal(t, vm.Qword(3), v.Registers[1])
+
+	// the code is the same wherever it is placed
+	moved, err := parser("set 1 0\nf:" + code)
+	assert.NoError(t, err)
+	assert.Equal(t, p, moved[18:])
+
+	// relative labels are resolved in objects without relocations
+	a := ops.List.Assembler()
+	o, err := a.Object("rel.vm", "f:"+code)
+	assert.NoError(t, err)
+	assert.Empty(t, o.Relocs)
+	assert.Equal(t, p, o.Sections[0].Data)
+
+	dis, err := vm.Disassemble(p, ops.List)
+	assert.NoError(t, err)
+	assert.Contains(t, dis, "br L64\n")
+	assert.Contains(t, dis, "brnz 0 L28\n")
+	p2, err := parser(dis)
+	assert.NoError(t, err)
+	assert.Equal(t, p, p2)
+
+	_, err = parser(`
+		br far
+		#page 1
+		far:
+		stop
+	`)
+	if le, ok := err.(vm.LineError); assert.True(t, ok) {
+		assert.Equal(t, "Relative label in another page", le.ErrorType)
+		assert.Equal(t, 1, le.LineNumber)
+	}
+	_, err = parser(`
+		#def N 4
+		br N
+	`)
+	assert.Error(t, err)
+	_, err = a.Object("rel.vm", "br elsewhere")
+	assert.Error(t, err)
+}
+
+func TestCallStack(t *testing.T) {
+	parser := ops.List.Parser()
+	// sum counts down from R0 adding to R1 using recursion
+	p, err := parser(`
+		callv 0 sum
+		stop
+		sum:
+		brz   0 .done
+		iadd  1 0
+		isubv 0 1
+		callv 0 sum
+		.done:
+		ret
+	`)
+	assert.NoError(t, err)
+
+	v := vm.New([]vm.Qword{10, 0}, p, ops.List.Ops())
+	assert.NoError(t, v.Run())
+	assert.Equal(t, vm.Qword(55), v.Registers[1])
+	assert.Empty(t, v.Stack)
+
+	v = vm.New([]vm.Qword{10, 0}, p, ops.List.Ops())
+	v.MaxDepth = 5
+	assert.Equal(t, vm.ErrStackOverflow, v.Run())
+	assert.Len(t, v.Stack, 5)
+	assert.Equal(t, vm.Location{Page: 0, Pos: 18}, v.Stack[0])
+	assert.Equal(t, vm.Location{Page: 0, Pos: 92}, v.Stack[4])
+
+	v = vm.New([]vm.Qword{10, 0}, p, ops.List.Ops())
+	v.Registers[0] = 100000
+	assert.Equal(t, vm.ErrStackOverflow, v.Run())
+	assert.Len(t, v.Stack, vm.DefaultMaxDepth)
+
+	p, err = parser("ret")
+	assert.NoError(t, err)
+	v = vm.New(nil, p, ops.List.Ops())
+	assert.Equal(t, vm.ErrEmptyStack, v.Run())
+
+	// going back restores the call stack
+	p, err = parser(`
+		callv 0 f
+		stop
+		f:
+		ret
+	`)
+	assert.NoError(t, err)
+	v = vm.New(nil, p, ops.List.Ops())
+	v.Record(10)
+	assert.NoError(t, v.Run())
+	assert.Empty(t, v.Stack)
+	assert.NoError(t, v.Back(2))
+	assert.Equal(t, []vm.Location{{Page: 0, Pos: 18}}, v.Stack)
+	assert.NoError(t, v.Back(1))
+	assert.Empty(t, v.Stack)
+	assert.NoError(t, v.Run())
+	assert.Equal(t, uint64(3), v.Count)
+}
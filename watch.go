@@ -0,0 +1,262 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Location is a position in a page.
+type Location struct {
+	Page, Pos uint64
+}
+
+// String returns the location as page:pos
+func (l Location) String() string {
+	return fmt.Sprintf("%d:%d", l.Page, l.Pos)
+}
+
+// HitKind indicates why a Hit happened
+type HitKind byte
+
+// HitKinds
+const (
+	// BreakpointHit is returned before running the op at a breakpoint.
+	BreakpointHit HitKind = iota
+	// RegisterHit is returned after an op changes a watched register.
+	RegisterHit
+	// MemoryHit is returned after an op changes watched memory.
+	MemoryHit
+)
+
+// Hit is returned as an error from Run and Step when a breakpoint or watchpoint
+// fires. At is the op that was about to run for a breakpoint or the op that
+// made the change for a watchpoint. Register is set for RegisterHit, Memory
+// and Size for MemoryHit. Old and New hold the value before and after.
+type Hit struct {
+	Kind     HitKind
+	At       Location
+	Register uint64
+	Memory   Location
+	Size     uint64
+	Old, New []byte
+}
+
+// Error fulfils the error interface
+func (h *Hit) Error() string {
+	switch h.Kind {
+	case RegisterHit:
+		return fmt.Sprintf("register %d changed at %s", h.Register, h.At)
+	case MemoryHit:
+		return fmt.Sprintf("memory %s+%d changed at %s", h.Memory, h.Size, h.At)
+	}
+	return fmt.Sprintf("breakpoint at %s", h.At)
+}
+
+// watcher holds breakpoints and watchpoints. VM.watch is nil when there are
+// none so that Run does not pay for them.
+type watcher struct {
+	breakpoints map[Location]bool
+	registers   map[uint64]Qword
+	memory      []memWatch
+	// skip is a breakpoint that was just returned, it is ignored if Run is
+	// called again without moving.
+	skip *Location
+}
+
+type memWatch struct {
+	at   Location
+	size uint64
+	last []byte
+}
+
+func (vm *VM) watcher() *watcher {
+	if vm.watch == nil {
+		vm.watch = &watcher{
+			breakpoints: make(map[Location]bool),
+			registers:   make(map[uint64]Qword),
+		}
+	}
+	return vm.watch
+}
+
+// cleanup removes the watcher once it is empty.
+func (vm *VM) cleanup() {
+	w := vm.watch
+	if len(w.breakpoints) == 0 && len(w.registers) == 0 && len(w.memory) == 0 {
+		vm.watch = nil
+	}
+}
+
+// SetBreakpoint causes Run to return a Hit before running the op at page, pos.
+func (vm *VM) SetBreakpoint(page, pos uint64) {
+	vm.watcher().breakpoints[Location{Page: page, Pos: pos}] = true
+}
+
+// ClearBreakpoint removes a breakpoint.
+func (vm *VM) ClearBreakpoint(page, pos uint64) {
+	if vm.watch != nil {
+		delete(vm.watch.breakpoints, Location{Page: page, Pos: pos})
+		vm.cleanup()
+	}
+}
+
+// Breakpoints returns the breakpoints in no particular order.
+func (vm *VM) Breakpoints() []Location {
+	if vm.watch == nil {
+		return nil
+	}
+	ls := make([]Location, 0, len(vm.watch.breakpoints))
+	for l := range vm.watch.breakpoints {
+		ls = append(ls, l)
+	}
+	return ls
+}
+
+// WatchRegister causes Run and Step to return a Hit after an op changes
+// register r.
+func (vm *VM) WatchRegister(r uint64) {
+	vm.watcher().registers[r] = vm.register(r)
+}
+
+// UnwatchRegister removes a register watchpoint.
+func (vm *VM) UnwatchRegister(r uint64) {
+	if vm.watch != nil {
+		delete(vm.watch.registers, r)
+		vm.cleanup()
+	}
+}
+
+// WatchMemory causes Run and Step to return a Hit after an op changes any of
+// the size bytes starting at page, pos. The memory does not need to exist yet.
+func (vm *VM) WatchMemory(page, pos, size uint64) {
+	m := memWatch{
+		at:   Location{Page: page, Pos: pos},
+		size: size,
+	}
+	m.last = vm.memory(m)
+	w := vm.watcher()
+	w.memory = append(w.memory, m)
+}
+
+// UnwatchMemory removes a memory watchpoint, the args must match the call to
+// WatchMemory.
+func (vm *VM) UnwatchMemory(page, pos, size uint64) {
+	if vm.watch == nil {
+		return
+	}
+	at := Location{Page: page, Pos: pos}
+	ms := vm.watch.memory[:0]
+	for _, m := range vm.watch.memory {
+		if m.at != at || m.size != size {
+			ms = append(ms, m)
+		}
+	}
+	vm.watch.memory = ms
+	vm.cleanup()
+}
+
+// reset updates the last seen values so changes made outside of an op, such
+// as going back, do not fire.
+func (w *watcher) reset(vm *VM) {
+	for r := range w.registers {
+		w.registers[r] = vm.register(r)
+	}
+	for i, m := range w.memory {
+		w.memory[i].last = vm.memory(m)
+	}
+}
+
+// register returns the value of r or 0 if it does not exist.
+func (vm *VM) register(r uint64) Qword {
+	if r < uint64(len(vm.Registers)) {
+		return vm.Registers[r]
+	}
+	return 0
+}
+
+// memory returns a copy of the watched memory, any part that does not exist is
+// left out.
+func (vm *VM) memory(m memWatch) []byte {
+	if m.at.Page >= uint64(len(vm.Pages)) {
+		return nil
+	}
+	page := vm.Pages[m.at.Page]
+	if m.at.Pos >= uint64(len(page)) {
+		return nil
+	}
+	end := m.at.Pos + m.size
+	if end > uint64(len(page)) || end < m.at.Pos {
+		end = uint64(len(page))
+	}
+	return append([]byte(nil), page[m.at.Pos:end]...)
+}
+
+// checkBreakpoint returns a Hit if there is a breakpoint at at. A breakpoint
+// that was just returned is skipped once so Run can be called again.
+func (vm *VM) checkBreakpoint(at Location) *Hit {
+	w := vm.watch
+	if w == nil {
+		return nil
+	}
+	if w.breakpoints[at] && (w.skip == nil || *w.skip != at) {
+		w.skip = &at
+		return &Hit{Kind: BreakpointHit, At: at}
+	}
+	w.skip = nil
+	return nil
+}
+
+// hit calls OnHit and returns true if Run should keep going.
+func (vm *VM) hit(h *Hit) bool {
+	return vm.OnHit != nil && vm.OnHit(h)
+}
+
+// checkWatches returns a Hit if a watched register or memory changed while
+// running the op at at.
+func (vm *VM) checkWatches(at Location) *Hit {
+	w := vm.watch
+	if w == nil {
+		return nil
+	}
+	var hit *Hit
+	for r, last := range w.registers {
+		q := vm.register(r)
+		if q == last {
+			continue
+		}
+		w.registers[r] = q
+		if hit == nil || r < hit.Register {
+			hit = &Hit{
+				Kind:     RegisterHit,
+				At:       at,
+				Register: r,
+				Old:      qwordBytes(last),
+				New:      qwordBytes(q),
+			}
+		}
+	}
+	for i, m := range w.memory {
+		b := vm.memory(m)
+		if bytes.Equal(b, m.last) {
+			continue
+		}
+		w.memory[i].last = b
+		if hit == nil {
+			hit = &Hit{
+				Kind:   MemoryHit,
+				At:     at,
+				Memory: m.at,
+				Size:   m.size,
+				Old:    m.last,
+				New:    b,
+			}
+		}
+	}
+	return hit
+}
+
+func qwordBytes(q Qword) []byte {
+	b := make([]byte, 8)
+	q.Put(&b[0])
+	return b
+}